@@ -1,24 +1,75 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"image"
 	"image/jpeg"
 	"imageconverter/src/transparency"
-	"os"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 )
 
+// calibrationFile stores the crossover points found by `./src calibrate`
+const calibrationFile = "calibration.json"
+
 func init() {
 	image.RegisterFormat("jpeg", "jpeg", jpeg.Decode, jpeg.DecodeConfig)
 }
 
 func main() {
 	defer transparency.Elapsed("imageConverter")()
+	debug := flag.Bool("debug", false, "also write the label map to icons/<image>-debug.png")
+	flag.Parse()
+
 	fileName := "clownFish"
-	if len(os.Args) >= 2 {
-		fileName = os.Args[1]
+	if flag.NArg() >= 1 {
+		fileName = flag.Arg(0)
+	}
+
+	if fileName == "calibrate" {
+		calibrate()
+		return
+	}
+
+	calibration, err := transparency.LoadCalibration(calibrationFile)
+	if err != nil {
+		// not calibrated yet
+		calibration = transparency.DefaultCalibration()
 	}
 
 	img := transparency.ReadFile(fileName)
-	background := transparency.RunIcon(img, 64, true)
-	transparency.WriteFile(fileName, background)
+	res := transparency.RunIconWithOptions(img, transparency.Options{
+		Chunks:      transparency.AutoChunks,
+		Calibration: &calibration,
+		Debug:       *debug,
+	})
+	fmt.Printf("ran with %d chunks, threaded %v\n", res.Chunks, res.Threaded)
+	transparency.WriteFile(fileName, res.Icon)
+	if res.Debug != nil {
+		transparency.WriteFile(fileName+"-debug", res.Debug)
+	}
+}
+
+// calibrate times the labeling modes on the bundled images and saves the
+// crossover points for AutoChunks
+func calibrate() {
+	files, err := ioutil.ReadDir("../images")
+	if err != nil {
+		panic(err)
+	}
+
+	var images []image.Image
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".jpeg" {
+			images = append(images, transparency.ReadFile(strings.TrimSuffix(file.Name(), ".jpeg")))
+		}
+	}
+
+	calibration := transparency.Calibrate(images, 3)
+	if err := calibration.Save(calibrationFile); err != nil {
+		panic(err)
+	}
+	fmt.Printf("saved %+v to %s\n", calibration, calibrationFile)
 }
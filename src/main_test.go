@@ -1,10 +1,44 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
 	"imageconverter/src/transparency"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 )
 
+var (
+	white = color.RGBA{255, 255, 255, 255}
+	red   = color.RGBA{200, 20, 20, 255}
+	blue  = color.RGBA{40, 80, 200, 255}
+)
+
+// newFilledImage returns a width x height image painted with fill
+func newFilledImage(width, height int, fill color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	fillRect(img, img.Rect, fill)
+	return img
+}
+
+// fillRect paints every pixel of rect in img
+func fillRect(img *image.RGBA, rect image.Rectangle, fill color.Color) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			img.Set(x, y, fill)
+		}
+	}
+}
+
 func TestClownFish(t *testing.T) {
 	img := transparency.ReadFile("clownfish")
 	compareImg := transparency.ReadPngFile("clownfishReal")
@@ -35,9 +69,1112 @@ func TestClownFish(t *testing.T) {
 	}
 }
 
+func TestNoisyBackground(t *testing.T) {
+	// jpeg-like noise: hardly two background pixels share a color, while every
+	// pixel of the smaller icon does - an exact color count would pick the icon
+	base := [3]int{36, 68, 148}
+	img := newFilledImage(60, 60, white)
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 60; x++ {
+			img.Set(x, y, color.RGBA{
+				uint8(base[0] + (x*2+y*3)%7 - 3),
+				uint8(base[1] + (x*5+y)%7 - 3),
+				uint8(base[2] + (x*3+y*4)%7 - 3),
+				255,
+			})
+		}
+	}
+	fillRect(img, image.Rect(20, 20, 40, 40), red)
+
+	res := transparency.RunIconWithOptions(img, transparency.Options{})
+	for i, c := range res.Background.Color {
+		if diff := int(c>>8) - base[i]; diff < -1 || diff > 1 {
+			t.Fatalf("expected the background near %v, got %v", base, res.Background.Color)
+		}
+	}
+	if res.Icon.Rect.Dx() != 19 || res.Icon.Rect.Dy() != 19 {
+		t.Fatalf("expected the red square as the icon, got %v", res.Icon.Rect)
+	}
+}
+
+func TestBorderBackground(t *testing.T) {
+	// the icon covers most of the frame so it wins the popularity vote
+	img := newFilledImage(60, 60, white)
+	fillRect(img, image.Rect(5, 5, 55, 55), red)
+
+	popular := transparency.RunIconWithOptions(img, transparency.Options{})
+	if !transparency.ColorCompare(rgbColor(popular.Background.Color), red) {
+		t.Fatalf("popularity background should be the icon color, got %v", popular.Background.Color)
+	}
+
+	border := transparency.RunIconWithOptions(img, transparency.Options{
+		Background:  transparency.BorderBackground,
+		BorderWidth: 3,
+	})
+	if border.Strategy != transparency.BorderBackground {
+		t.Fatalf("expected border strategy to be reported, got %v", border.Strategy)
+	}
+	if !transparency.ColorCompare(rgbColor(border.Background.Color), white) {
+		t.Fatalf("border background should be white, got %v", border.Background.Color)
+	}
+	if border.Background.Spread != 0 {
+		t.Fatalf("uniform border should have no spread, got %f", border.Background.Spread)
+	}
+	if !transparency.ColorCompare(border.Icon.At(10, 10), red) {
+		t.Fatalf("expected the red square as icon, got %v", border.Icon.At(10, 10))
+	}
+}
+
+func TestGradientBackground(t *testing.T) {
+	// a left to right lighting gradient far wider than the color cutoff
+	img := image.NewRGBA(image.Rect(0, 0, 160, 80))
+	for x := 0; x < 160; x++ {
+		shade := uint8(40 + x*200/160)
+		fillRect(img, image.Rect(x, 0, x+1, 80), color.RGBA{shade, shade, shade, 255})
+	}
+	fillRect(img, image.Rect(70, 30, 90, 50), red)
+
+	uniform := transparency.RunIconWithOptions(img, transparency.Options{})
+	if uniform.Icon.Rect.Dx() <= 20 {
+		t.Fatalf("expected the uniform model to keep part of the gradient, got %v", uniform.Icon.Rect)
+	}
+
+	gradient := transparency.RunIconWithOptions(img, transparency.Options{
+		Model: transparency.GradientModel,
+	})
+	if gradient.Model != transparency.GradientModel {
+		t.Fatalf("expected gradient model to be reported, got %v", gradient.Model)
+	}
+	// dimensions are trimmed by one row/column, same as every RunIcon crop
+	if gradient.Icon.Rect.Dx() != 19 || gradient.Icon.Rect.Dy() != 19 {
+		t.Fatalf("expected only the red square, got %v", gradient.Icon.Rect)
+	}
+	if !transparency.ColorCompare(gradient.Icon.At(5, 5), red) {
+		t.Fatalf("expected the red square as icon, got %v", gradient.Icon.At(5, 5))
+	}
+}
+
+func TestPaletteBackground(t *testing.T) {
+	// two-tone striped background around a red square
+	img := newFilledImage(100, 100, white)
+	for y := 0; y < 100; y += 20 {
+		fillRect(img, image.Rect(0, y, 100, y+10), blue)
+	}
+	fillRect(img, image.Rect(40, 40, 60, 60), red)
+
+	for _, opts := range []transparency.Options{
+		{PaletteSize: 2},
+		{Palette: []color.Color{white, blue}},
+	} {
+		res := transparency.RunIconWithOptions(img, opts)
+		if len(res.Palette) != 2 {
+			t.Fatalf("expected two background colors, got %v", res.Palette)
+		}
+		if res.Icon.Rect.Dx() != 19 || res.Icon.Rect.Dy() != 19 {
+			t.Fatalf("expected only the red square, got %v", res.Icon.Rect)
+		}
+	}
+}
+
+func TestColorMetrics(t *testing.T) {
+	img := newFilledImage(60, 60, white)
+	fillRect(img, image.Rect(20, 20, 40, 40), red)
+	whiteRGB := [3]uint32{0xffff, 0xffff, 0xffff}
+
+	for _, metric := range []transparency.ColorMetric{
+		transparency.EuclideanRGB{},
+		transparency.DeltaE76{},
+		transparency.DeltaE94{},
+		transparency.DeltaE2000{},
+	} {
+		if d := metric.Distance(whiteRGB, whiteRGB); d > 1e-9 {
+			t.Fatalf("%T: same color should have no distance, got %f", metric, d)
+		}
+
+		res := transparency.RunIconWithOptions(img, transparency.Options{Metric: metric})
+		if res.Icon.Rect.Dx() != 19 || res.Icon.Rect.Dy() != 19 {
+			t.Fatalf("%T: expected only the red square, got %v", metric, res.Icon.Rect)
+		}
+	}
+
+	// black to white is the whole lightness axis
+	if d := (transparency.DeltaE76{}).Distance([3]uint32{}, whiteRGB); math.Abs(d-100) > 1e-3 {
+		t.Fatalf("DeltaE76: expected black to white to be 100, got %f", d)
+	}
+
+	for _, tc := range []struct {
+		metric interface {
+			DistanceLab(pixel, background transparency.Lab) float64
+		}
+		pixel, background transparency.Lab
+		expected          float64
+	}{
+		{transparency.DeltaE76{}, transparency.Lab{L: 50, A: 3, B: 4}, transparency.Lab{L: 50}, 5},
+		{transparency.DeltaE76{}, transparency.Lab{L: 60, A: -2, B: 2}, transparency.Lab{L: 50, A: 0, B: 0}, math.Sqrt(108)},
+		// a lightness difference isn't weighted
+		{transparency.DeltaE94{}, transparency.Lab{L: 60}, transparency.Lab{L: 50}, 10},
+		// a pure chroma difference is divided by 1 + 0.045 * 50
+		{transparency.DeltaE94{}, transparency.Lab{L: 50}, transparency.Lab{L: 50, A: 30, B: 40}, 50 / 3.25},
+		// a pure hue difference is divided by 1 + 0.015 * 50
+		{transparency.DeltaE94{}, transparency.Lab{L: 50, B: 50}, transparency.Lab{L: 50, A: 50}, 50 * math.Sqrt2 / 1.75},
+	} {
+		if d := tc.metric.DistanceLab(tc.pixel, tc.background); math.Abs(d-tc.expected) > 1e-9 {
+			t.Fatalf("%T: %v to %v expected %f, got %f", tc.metric, tc.pixel, tc.background, tc.expected, d)
+		}
+	}
+
+	// the CIEDE2000 test data from Sharma, Wu and Dalal
+	// http://www2.ece.rochester.edu/~gsharma/ciede2000/
+	for i, pair := range [][7]float64{
+		{50.0000, 2.6772, -79.7751, 50.0000, 0.0000, -82.7485, 2.0425},
+		{50.0000, 3.1571, -77.2803, 50.0000, 0.0000, -82.7485, 2.8615},
+		{50.0000, 2.8361, -74.0200, 50.0000, 0.0000, -82.7485, 3.4412},
+		{50.0000, -1.3802, -84.2814, 50.0000, 0.0000, -82.7485, 1.0000},
+		{50.0000, -1.1848, -84.8006, 50.0000, 0.0000, -82.7485, 1.0000},
+		{50.0000, -0.9009, -85.5211, 50.0000, 0.0000, -82.7485, 1.0000},
+		{50.0000, 0.0000, 0.0000, 50.0000, -1.0000, 2.0000, 2.3669},
+		{50.0000, -1.0000, 2.0000, 50.0000, 0.0000, 0.0000, 2.3669},
+		{50.0000, 2.4900, -0.0010, 50.0000, -2.4900, 0.0009, 7.1792},
+		{50.0000, 2.4900, -0.0010, 50.0000, -2.4900, 0.0010, 7.1792},
+		{50.0000, 2.4900, -0.0010, 50.0000, -2.4900, 0.0011, 7.2195},
+		{50.0000, 2.4900, -0.0010, 50.0000, -2.4900, 0.0012, 7.2195},
+		{50.0000, -0.0010, 2.4900, 50.0000, 0.0009, -2.4900, 4.8045},
+		{50.0000, -0.0010, 2.4900, 50.0000, 0.0010, -2.4900, 4.8045},
+		{50.0000, -0.0010, 2.4900, 50.0000, 0.0011, -2.4900, 4.7461},
+		{50.0000, 2.5000, 0.0000, 50.0000, 0.0000, -2.5000, 4.3065},
+		{50.0000, 2.5000, 0.0000, 73.0000, 25.0000, -18.0000, 27.1492},
+		{50.0000, 2.5000, 0.0000, 61.0000, -5.0000, 29.0000, 22.8977},
+		{50.0000, 2.5000, 0.0000, 56.0000, -27.0000, -3.0000, 31.9030},
+		{50.0000, 2.5000, 0.0000, 58.0000, 24.0000, 15.0000, 19.4535},
+		{50.0000, 2.5000, 0.0000, 50.0000, 3.1736, 0.5854, 1.0000},
+		{50.0000, 2.5000, 0.0000, 50.0000, 3.2972, 0.0000, 1.0000},
+		{50.0000, 2.5000, 0.0000, 50.0000, 1.8634, 0.5757, 1.0000},
+		{50.0000, 2.5000, 0.0000, 50.0000, 3.2592, 0.3350, 1.0000},
+		{60.2574, -34.0099, 36.2677, 60.4626, -34.1751, 39.4387, 1.2644},
+		{63.0109, -31.0961, -5.8663, 62.8187, -29.7946, -4.0864, 1.2630},
+		{61.2901, 3.7196, -5.3901, 61.4292, 2.2480, -4.9620, 1.8731},
+		{35.0831, -44.1164, 3.7933, 35.0232, -40.0716, 1.5901, 1.8645},
+		{22.7233, 20.0904, -46.6940, 23.0331, 14.9730, -42.5619, 2.0373},
+		{36.4612, 47.8580, 18.3852, 36.2715, 50.5065, 21.2231, 1.4146},
+		{90.8027, -2.0831, 1.4410, 91.1528, -1.6435, 0.0447, 1.4441},
+		{90.9257, -0.5406, -0.9208, 88.6381, -0.8985, -0.7239, 1.5381},
+		{6.7747, -0.2908, -2.4247, 5.8714, -0.0985, -2.2286, 0.6377},
+		{2.0776, 0.0795, -1.1350, 0.9033, -0.0636, -0.5514, 0.9082},
+	} {
+		lab1 := transparency.Lab{L: pair[0], A: pair[1], B: pair[2]}
+		lab2 := transparency.Lab{L: pair[3], A: pair[4], B: pair[5]}
+		for _, d := range []float64{
+			transparency.DeltaE2000{}.DistanceLab(lab1, lab2),
+			transparency.DeltaE2000{}.DistanceLab(lab2, lab1),
+		} {
+			if math.Abs(d-pair[6]) > 5e-5 {
+				t.Fatalf("DeltaE2000: pair %d expected %.4f, got %.6f", i+1, pair[6], d)
+			}
+		}
+	}
+}
+
+func TestAutoThreshold(t *testing.T) {
+	img := newFilledImage(60, 60, white)
+	fillRect(img, image.Rect(20, 20, 40, 40), red)
+	gap := transparency.EuclideanRGB{}.Distance([3]uint32{0xffff, 0xffff, 0xffff}, [3]uint32{
+		200 * 0x101, 20 * 0x101, 20 * 0x101,
+	})
+
+	auto := transparency.RunIconWithOptions(img, transparency.Options{AutoThreshold: true})
+	if auto.AutoThreshold <= 0 || auto.AutoThreshold > gap {
+		t.Fatalf("expected the threshold between background and icon, got %f", auto.AutoThreshold)
+	}
+	if auto.Threshold != auto.AutoThreshold {
+		t.Fatalf("expected the auto threshold to be applied, got %f", auto.Threshold)
+	}
+	if auto.Icon.Rect.Dx() != 19 || auto.Icon.Rect.Dy() != 19 {
+		t.Fatalf("expected only the red square, got %v", auto.Icon.Rect)
+	}
+
+	manual := transparency.RunIconWithOptions(img, transparency.Options{
+		AutoThreshold: true,
+		Threshold:     5000,
+	})
+	if manual.Threshold != 5000 || manual.AutoThreshold != auto.AutoThreshold {
+		t.Fatalf("expected the manual override to win, got %f (auto %f)",
+			manual.Threshold, manual.AutoThreshold)
+	}
+}
+
+func TestChromaKey(t *testing.T) {
+	screen := color.RGBA{40, 200, 40, 255}
+	shadow := color.RGBA{10, 90, 10, 255}
+	spill := color.RGBA{150, 170, 150, 255}
+
+	img := newFilledImage(80, 80, screen)
+	fillRect(img, image.Rect(30, 30, 50, 50), red)
+	// the subject casts a shadow on the screen right next to it
+	fillRect(img, image.Rect(50, 20, 70, 60), shadow)
+	img.Set(35, 35, spill)
+
+	plain := transparency.RunIconWithOptions(img, transparency.Options{})
+	if plain.Icon.Rect.Dx() <= 19 {
+		t.Fatalf("expected the shadow to be kept without keying, got %v", plain.Icon.Rect)
+	}
+
+	key := transparency.GreenScreen()
+	keyed := transparency.RunIconWithOptions(img, transparency.Options{ChromaKey: &key})
+	if keyed.Icon.Rect.Dx() != 19 || keyed.Icon.Rect.Dy() != 19 {
+		t.Fatalf("expected only the red square, got %v", keyed.Icon.Rect)
+	}
+
+	r, g, _, a := keyed.Icon.At(5, 5).RGBA()
+	if a != 0xffff || g > r {
+		t.Fatalf("expected the green spill to be removed, got %v", keyed.Icon.At(5, 5))
+	}
+}
+
+func TestConnectivity(t *testing.T) {
+	// a one pixel diagonal line bridges two squares across the chunk seams
+	img := newFilledImage(80, 80, white)
+	fillRect(img, image.Rect(5, 5, 35, 35), red)
+	fillRect(img, image.Rect(50, 50, 70, 70), red)
+	for i := 35; i < 50; i++ {
+		img.Set(i, i, red)
+	}
+
+	for _, opts := range []transparency.Options{
+		{},
+		{Chunks: 4},
+		{Chunks: 4, Threaded: true},
+	} {
+		eight := transparency.RunIconWithOptions(img, opts)
+		if eight.Icon.Rect.Dx() != 64 || eight.Icon.Rect.Dy() != 64 {
+			t.Fatalf("%+v: expected the diagonal to bridge both squares, got %v", opts, eight.Icon.Rect)
+		}
+
+		opts.Connectivity = transparency.FourConnected
+		four := transparency.RunIconWithOptions(img, opts)
+		if four.Icon.Rect.Dx() != 29 || four.Icon.Rect.Dy() != 29 {
+			t.Fatalf("%+v: expected only the bigger square, got %v", opts, four.Icon.Rect)
+		}
+	}
+}
+
+func TestExtractIcons(t *testing.T) {
+	// a small sprite sheet with a speck of noise
+	img := newFilledImage(90, 60, white)
+	fillRect(img, image.Rect(5, 5, 25, 25), red)
+	fillRect(img, image.Rect(35, 10, 65, 40), blue)
+	fillRect(img, image.Rect(70, 40, 80, 50), red)
+	img.Set(50, 55, blue)
+
+	for _, opts := range []transparency.Options{{}, {Chunks: 4, Threaded: true}} {
+		icons := transparency.ExtractIcons(img, opts, 10)
+		if len(icons) != 3 {
+			t.Fatalf("%+v: expected 3 icons, got %d", opts, len(icons))
+		}
+
+		expected := []struct {
+			bounds image.Rectangle
+			pixels int
+		}{
+			{image.Rect(35, 10, 65, 40), 900},
+			{image.Rect(5, 5, 25, 25), 400},
+			{image.Rect(70, 40, 80, 50), 100},
+		}
+		for i, icon := range icons {
+			if icon.Bounds != expected[i].bounds || icon.Pixels != expected[i].pixels {
+				t.Fatalf("%+v: icon %d expected at %v with %d pixels, got %v with %d",
+					opts, i, expected[i].bounds, expected[i].pixels, icon.Bounds, icon.Pixels)
+			}
+			if icon.Image.Rect.Size() != icon.Bounds.Size() {
+				t.Fatalf("%+v: icon %d crop %v doesn't match its bounds %v",
+					opts, i, icon.Image.Rect, icon.Bounds)
+			}
+			opaque := 0
+			for j := 0; j < len(icon.Image.Pix); j += 4 {
+				if icon.Image.Pix[j+3] != 0 {
+					opaque++
+				}
+			}
+			if opaque != icon.Pixels {
+				t.Fatalf("%+v: icon %d expected %d opaque pixels, got %d", opts, i, icon.Pixels, opaque)
+			}
+		}
+	}
+
+	// dilating grows the crop past the component, Bounds follows it
+	img = newFilledImage(50, 50, white)
+	fillRect(img, image.Rect(20, 20, 30, 30), red)
+	dilated := transparency.ExtractIcons(img, transparency.Options{
+		Morphology: []transparency.MorphologyOp{{Kind: transparency.Dilate, Element: transparency.SquareElement(3)}},
+	}, 1)
+	if len(dilated) != 1 {
+		t.Fatalf("expected 1 icon, got %d", len(dilated))
+	}
+	if icon := dilated[0]; icon.Bounds != image.Rect(17, 17, 33, 33) ||
+		icon.Image.Rect.Size() != icon.Bounds.Size() || icon.Pixels != 16*16 {
+		t.Fatalf("expected the dilated square at (17,17)-(33,33), got %v cropped to %v with %d pixels",
+			icon.Bounds, icon.Image.Rect, icon.Pixels)
+	}
+
+	// a hairline and a lone pixel still come out whole
+	img = newFilledImage(30, 10, white)
+	fillRect(img, image.Rect(5, 2, 20, 3), red)
+	img.Set(25, 7, blue)
+	icons := transparency.ExtractIcons(img, transparency.Options{}, 1)
+	if len(icons) != 2 {
+		t.Fatalf("expected 2 icons, got %d", len(icons))
+	}
+	if icons[0].Image.Rect != image.Rect(0, 0, 15, 1) || !transparency.ColorCompare(icons[0].Image.At(14, 0), red) {
+		t.Fatalf("expected the whole hairline, got %v", icons[0].Image.Rect)
+	}
+	if icons[1].Image.Rect != image.Rect(0, 0, 1, 1) || !transparency.ColorCompare(icons[1].Image.At(0, 0), blue) {
+		t.Fatalf("expected the lone pixel, got %v", icons[1].Image.Rect)
+	}
+}
+
+func TestSelectionPolicies(t *testing.T) {
+	// a big stray shadow in the corner, a centered logo and a thin ring
+	img := newFilledImage(120, 120, white)
+	fillRect(img, image.Rect(0, 0, 40, 40), blue)
+	fillRect(img, image.Rect(50, 50, 70, 70), red)
+	fillRect(img, image.Rect(72, 72, 117, 117), red)
+	fillRect(img, image.Rect(74, 74, 115, 115), white)
+
+	for _, tc := range []struct {
+		name      string
+		selection transparency.SelectionPolicy
+		bounds    image.Rectangle
+	}{
+		{"default", nil, image.Rect(0, 0, 39, 39)},
+		{"largest bounds", transparency.LargestBounds(), image.Rect(0, 0, 44, 44)},
+		{"closest to center", transparency.ClosestToCenter(10), image.Rect(0, 0, 19, 19)},
+		{"containing point", transparency.ContainingPoint(image.Pt(73, 100)), image.Rect(0, 0, 44, 44)},
+		{"custom", func(components []transparency.Component, frame image.Rectangle) int {
+			// the last component in scan order
+			return len(components) - 1
+		}, image.Rect(0, 0, 44, 44)},
+	} {
+		res := transparency.RunIconWithOptions(img, transparency.Options{Selection: tc.selection})
+		if res.Icon.Rect != tc.bounds {
+			t.Fatalf("%s: expected icon %v, got %v", tc.name, tc.bounds, res.Icon.Rect)
+		}
+	}
+
+	res := transparency.RunIconWithOptions(img, transparency.Options{
+		Selection: transparency.ContainingPoint(image.Pt(45, 45)),
+	})
+	if !res.Icon.Rect.Empty() {
+		t.Fatalf("expected no icon on the background, got %v", res.Icon.Rect)
+	}
+
+	// every blob is below the minimum, nothing is picked
+	img = newFilledImage(40, 20, white)
+	fillRect(img, image.Rect(5, 5, 8, 8), red)
+	fillRect(img, image.Rect(20, 5, 24, 9), blue)
+	res = transparency.RunIconWithOptions(img, transparency.Options{Selection: transparency.ClosestToCenter(100)})
+	if res.Selected != -1 || !res.Icon.Rect.Empty() {
+		t.Fatalf("expected no icon when every component is too small, got %d (%v)", res.Selected, res.Icon.Rect)
+	}
+
+	// a one pixel high hairline spans a bigger box than a small blob
+	img = newFilledImage(60, 20, white)
+	fillRect(img, image.Rect(5, 5, 55, 6), red)
+	fillRect(img, image.Rect(20, 10, 23, 13), blue)
+	res = transparency.RunIconWithOptions(img, transparency.Options{Selection: transparency.LargestBounds()})
+	if res.Selected < 0 || res.Components[res.Selected].Bounds != image.Rect(5, 5, 55, 6) {
+		t.Fatalf("expected the hairline to have the largest bounds, got %+v", res.Components)
+	}
+}
+
+func TestBorderConnected(t *testing.T) {
+	// a ring with a white eye inside, and a notch open to the outside
+	img := newFilledImage(60, 60, white)
+	fillRect(img, image.Rect(10, 10, 50, 50), red)
+	fillRect(img, image.Rect(20, 20, 30, 30), white)
+	fillRect(img, image.Rect(40, 25, 50, 35), white)
+
+	for _, tc := range []struct {
+		borderConnected bool
+		eyeAlpha        uint32
+	}{
+		{false, 0},
+		{true, 0xffff},
+	} {
+		res := transparency.RunIconWithOptions(img, transparency.Options{
+			BorderConnected: tc.borderConnected,
+		})
+
+		if _, _, _, a := res.Icon.At(15, 15).RGBA(); a != tc.eyeAlpha {
+			t.Fatalf("border connected %v: expected eye alpha %d, got %d", tc.borderConnected, tc.eyeAlpha, a)
+		}
+		if _, _, _, a := res.Icon.At(35, 20).RGBA(); a != 0 {
+			t.Fatalf("border connected %v: expected the notch to stay transparent", tc.borderConnected)
+		}
+	}
+}
+
+func TestMaxHoleArea(t *testing.T) {
+	// a pinhole and a big ring opening inside the same icon
+	img := newFilledImage(60, 60, white)
+	fillRect(img, image.Rect(10, 10, 50, 50), red)
+	fillRect(img, image.Rect(15, 15, 18, 18), white)
+	fillRect(img, image.Rect(25, 25, 45, 45), white)
+
+	res := transparency.RunIconWithOptions(img, transparency.Options{MaxHoleArea: 20})
+	if !transparency.ColorCompare(res.Icon.At(6, 6), white) {
+		t.Fatalf("expected the pinhole to be filled, got %v", res.Icon.At(6, 6))
+	}
+	if _, _, _, a := res.Icon.At(25, 25).RGBA(); a != 0 {
+		t.Fatalf("expected the ring opening to stay transparent, got alpha %d", a)
+	}
+}
+
+func TestSpeckleFilter(t *testing.T) {
+	// jpeg-like specks, one dead center and one inside the logo's opening
+	img := newFilledImage(100, 100, white)
+	fillRect(img, image.Rect(31, 31, 46, 71), red)
+	fillRect(img, image.Rect(31, 31, 71, 41), red)
+	fillRect(img, image.Rect(31, 61, 71, 71), red)
+	img.Set(50, 50, blue)
+	img.Set(90, 10, blue)
+	img.Set(10, 90, blue)
+
+	center := transparency.RunIconWithOptions(img, transparency.Options{
+		Selection: transparency.ClosestToCenter(0),
+	})
+	if center.Icon.Rect.Dx() != 0 {
+		t.Fatalf("expected the center speck to win without filtering, got %v", center.Icon.Rect)
+	}
+
+	filtered := transparency.RunIconWithOptions(img, transparency.Options{
+		Selection:        transparency.ClosestToCenter(0),
+		MinComponentArea: 20,
+	})
+	if filtered.Icon.Rect.Dx() != 39 || filtered.Icon.Rect.Dy() != 39 {
+		t.Fatalf("expected the logo once specks are dropped, got %v", filtered.Icon.Rect)
+	}
+	if _, _, _, a := filtered.Icon.At(19, 19).RGBA(); a != 0 {
+		t.Fatalf("expected the dropped speck to be transparent, got alpha %d", a)
+	}
+
+	absorbed := transparency.RunIconWithOptions(img, transparency.Options{
+		MinComponentArea: 20,
+		AbsorbSpeckles:   true,
+	})
+	if _, _, _, a := absorbed.Icon.At(19, 19).RGBA(); a != 0 {
+		t.Fatalf("expected the speck in the logo's opening to stay transparent, got alpha %d", a)
+	}
+
+	// a speck in the ring's hole
+	ring := newFilledImage(80, 80, white)
+	fillRect(ring, image.Rect(20, 20, 60, 60), red)
+	fillRect(ring, image.Rect(30, 30, 50, 50), white)
+	ring.Set(40, 40, blue)
+
+	absorbed = transparency.RunIconWithOptions(ring, transparency.Options{
+		MinComponentArea: 20,
+		AbsorbSpeckles:   true,
+	})
+	if !transparency.ColorCompare(absorbed.Icon.At(20, 20), blue) {
+		t.Fatalf("expected the speck in the ring's hole to be absorbed, got %v", absorbed.Icon.At(20, 20))
+	}
+
+	// specks in the empty quadrant of an L, one of them sticking out of its box
+	l := newFilledImage(80, 80, white)
+	fillRect(l, image.Rect(20, 20, 30, 60), red)
+	fillRect(l, image.Rect(20, 50, 60, 60), red)
+	l.Set(40, 35, blue)
+	fillRect(l, image.Rect(58, 25, 62, 26), blue)
+
+	absorbed = transparency.RunIconWithOptions(l, transparency.Options{
+		MinComponentArea: 20,
+		AbsorbSpeckles:   true,
+	})
+	if absorbed.Icon.Rect.Dx() != 39 || absorbed.Icon.Rect.Dy() != 39 {
+		t.Fatalf("expected the speck outside the L not to grow the crop, got %v", absorbed.Icon.Rect)
+	}
+	if _, _, _, a := absorbed.Icon.At(20, 15).RGBA(); a != 0 {
+		t.Fatalf("expected the speck in the L's empty quadrant to stay transparent, got alpha %d", a)
+	}
+	if _, _, _, a := absorbed.Icon.At(38, 5).RGBA(); a != 0 {
+		t.Fatalf("expected the speck sticking out of the L to stay transparent, got alpha %d", a)
+	}
+}
+
+func TestMorphology(t *testing.T) {
+	// a hairline crack into the top of the logo and a one pixel spur on its side
+	img := newFilledImage(70, 70, white)
+	fillRect(img, image.Rect(20, 20, 50, 50), red)
+	fillRect(img, image.Rect(35, 20, 36, 40), white)
+	fillRect(img, image.Rect(50, 30, 60, 31), red)
+
+	closed := transparency.RunIconWithOptions(img, transparency.Options{
+		Morphology: []transparency.MorphologyOp{
+			{Kind: transparency.Close, Element: transparency.SquareElement(1)},
+		},
+	})
+	if _, _, _, a := closed.Icon.At(15, 10).RGBA(); a != 0xffff {
+		t.Fatalf("expected close to seal the crack, got alpha %d", a)
+	}
+
+	opened := transparency.RunIconWithOptions(img, transparency.Options{
+		Morphology: []transparency.MorphologyOp{
+			{Kind: transparency.Open, Element: transparency.SquareElement(1)},
+		},
+	})
+	if opened.Icon.Rect.Dx() != 29 || opened.Icon.Rect.Dy() != 29 {
+		t.Fatalf("expected open to cut the spur, got %v", opened.Icon.Rect)
+	}
+
+	eroded := transparency.RunIconWithOptions(img, transparency.Options{
+		Morphology: []transparency.MorphologyOp{
+			{Kind: transparency.Erode, Element: transparency.DiskElement(1)},
+		},
+	})
+	// the spur's root keeps the right edge, the top and bottom lose a row each
+	if eroded.Icon.Rect.Dx() != 28 || eroded.Icon.Rect.Dy() != 27 {
+		t.Fatalf("expected erode to shave the outline, got %v", eroded.Icon.Rect)
+	}
+}
+
+func TestComponentStats(t *testing.T) {
+	img := newFilledImage(60, 60, white)
+	fillRect(img, image.Rect(20, 20, 40, 40), red)
+	fillRect(img, image.Rect(50, 0, 60, 10), blue)
+
+	for _, opts := range []transparency.Options{{}, {Chunks: 4, Threaded: true}} {
+		res := transparency.RunIconWithOptions(img, opts)
+		if len(res.Components) != 2 || res.Selected < 0 {
+			t.Fatalf("%+v: expected 2 components and a selection, got %d (%d)",
+				opts, len(res.Components), res.Selected)
+		}
+
+		icon := res.Components[res.Selected]
+		if icon.Pixels != 400 || icon.Perimeter != 80 || icon.TouchesBorder {
+			t.Fatalf("%+v: unexpected icon stats %+v", opts, icon)
+		}
+		if icon.CentroidX != 29.5 || icon.CentroidY != 29.5 {
+			t.Fatalf("%+v: expected the centroid at 29.5,29.5, got %f,%f",
+				opts, icon.CentroidX, icon.CentroidY)
+		}
+		if !transparency.ColorCompare(icon.MeanColor, red) {
+			t.Fatalf("%+v: expected a red mean color, got %v", opts, icon.MeanColor)
+		}
+
+		corner := res.Components[1-res.Selected]
+		if corner.Pixels != 100 || corner.Perimeter != 40 || !corner.TouchesBorder {
+			t.Fatalf("%+v: unexpected corner stats %+v", opts, corner)
+		}
+	}
+}
+
+// rgbColor turns a 16 bit background triple back into a color
+func rgbColor(c [3]uint32) color.Color {
+	return color.RGBA64{uint16(c[0]), uint16(c[1]), uint16(c[2]), 0xffff}
+}
+
+func TestTwoPassLabeling(t *testing.T) {
+	// the U and the W only join up at the bottom, after both arms got labels
+	img := newFilledImage(90, 90, white)
+	fillRect(img, image.Rect(5, 5, 15, 60), red)
+	fillRect(img, image.Rect(35, 5, 45, 60), red)
+	fillRect(img, image.Rect(5, 60, 45, 70), red)
+	for i := 0; i < 20; i++ {
+		img.Set(60+i, 5+i, blue)
+		img.Set(80-i, 5+i, blue)
+	}
+	fillRect(img, image.Rect(80, 80, 85, 85), blue)
+
+	for _, opts := range []transparency.Options{
+		{},
+		{Chunks: 4},
+		{Chunks: 9, Threaded: true},
+		{Chunks: 4, Connectivity: transparency.FourConnected},
+	} {
+		dfs := transparency.RunIconWithOptions(img, opts)
+		opts.Labeling = transparency.TwoPassLabeling
+		twoPass := transparency.RunIconWithOptions(img, opts)
+
+		if len(dfs.Components) != len(twoPass.Components) {
+			t.Fatalf("%+v: expected %d components, got %d", opts, len(dfs.Components), len(twoPass.Components))
+		}
+		// the algorithms number their components differently, match them by their bounds
+		found := map[image.Rectangle]transparency.Component{}
+		for _, c := range twoPass.Components {
+			found[c.Bounds] = c
+		}
+		for _, expected := range dfs.Components {
+			actual := found[expected.Bounds]
+			if actual.Pixels != expected.Pixels || actual.Perimeter != expected.Perimeter ||
+				actual.CentroidX != expected.CentroidX || actual.CentroidY != expected.CentroidY ||
+				actual.MeanColor != expected.MeanColor {
+				t.Fatalf("%+v: expected component %+v, got %+v", opts, expected, actual)
+			}
+		}
+		if dfs.Icon.Rect != twoPass.Icon.Rect {
+			t.Fatalf("%+v: expected icon %v, got %v", opts, dfs.Icon.Rect, twoPass.Icon.Rect)
+		}
+		for i := range dfs.Icon.Pix {
+			if dfs.Icon.Pix[i] != twoPass.Icon.Pix[i] {
+				t.Fatalf("%+v: icons differ at byte %d", opts, i)
+			}
+		}
+	}
+}
+
+func TestChunkGrids(t *testing.T) {
+	// a wide panorama with shapes straddling the seams of every grid below
+	img := newFilledImage(240, 60, white)
+	fillRect(img, image.Rect(10, 10, 230, 20), red)
+	fillRect(img, image.Rect(10, 20, 20, 55), red)
+	fillRect(img, image.Rect(100, 30, 140, 50), blue)
+	for i := 0; i < 30; i++ {
+		img.Set(170+i, 25+i, blue)
+	}
+
+	expected := transparency.RunIconWithOptions(img, transparency.Options{})
+	for _, opts := range []transparency.Options{
+		{Chunks: 2},
+		{Chunks: 7},
+		{Chunks: 8, Threaded: true},
+		{ChunkRows: 3, ChunkCols: 5},
+		{ChunkRows: 1, ChunkCols: 16, Threaded: true},
+		{TileWidth: 17, TileHeight: 23},
+		{TileWidth: 64, Labeling: transparency.TwoPassLabeling},
+		{Chunks: 256, Threaded: true, Workers: 3},
+		{TileWidth: 5, TileHeight: 5, Threaded: true, Workers: 1},
+	} {
+		res := transparency.RunIconWithOptions(img, opts)
+		if len(res.Components) != len(expected.Components) {
+			t.Fatalf("%+v: expected %d components, got %d", opts, len(expected.Components), len(res.Components))
+		}
+		if res.Icon.Rect != expected.Icon.Rect {
+			t.Fatalf("%+v: expected icon %v, got %v", opts, expected.Icon.Rect, res.Icon.Rect)
+		}
+		icon := res.Components[res.Selected]
+		if icon.Pixels != expected.Components[expected.Selected].Pixels {
+			t.Fatalf("%+v: expected %d icon pixels, got %d", opts,
+				expected.Components[expected.Selected].Pixels, icon.Pixels)
+		}
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	img := newFilledImage(128, 128, white)
+	fillRect(img, image.Rect(20, 20, 100, 90), red)
+
+	goroutines := runtime.NumGoroutine()
+	icon := transparency.RunIcon(img, 4096, true)
+	if icon.Rect.Dx() != 79 || icon.Rect.Dy() != 69 {
+		t.Fatalf("expected a 79x69 icon, got %v", icon.Rect)
+	}
+	// the workers may still be returning after their last send
+	after := runtime.NumGoroutine()
+	for i := 0; i < 100 && after > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if after > goroutines {
+		t.Fatalf("expected the workers to exit, %d goroutines before and %d after", goroutines, after)
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	img := transparency.ReadFile("earthBg")
+	goroutines := runtime.NumGoroutine()
+
+	for _, opts := range []transparency.Options{
+		{},
+		{Chunks: 16},
+		{Chunks: 64, Threaded: true, Workers: 2},
+		{Labeling: transparency.TwoPassLabeling, Chunks: 16, Threaded: true},
+		// the deadline passes while fitting the classifier, before any labeling
+		{AutoThreshold: true, Metric: transparency.DeltaE2000{}},
+		{Model: transparency.GradientModel, Metric: transparency.DeltaE2000{}},
+	} {
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := transparency.RunIconContext(cancelled, img, opts); err != context.Canceled {
+			t.Fatalf("%+v: expected context.Canceled, got %v", opts, err)
+		}
+
+		// a deadline in the middle of the labeling
+		deadline, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		start := time.Now()
+		_, err := transparency.RunIconContext(deadline, img, opts)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("%+v: expected context.DeadlineExceeded, got %v", opts, err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Fatalf("%+v: expected to give up promptly, took %v", opts, elapsed)
+		}
+	}
+
+	after := runtime.NumGoroutine()
+	for i := 0; i < 100 && after > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if after > goroutines {
+		t.Fatalf("expected every goroutine to exit, %d before and %d after", goroutines, after)
+	}
+}
+
+func TestPixelFormats(t *testing.T) {
+	img := newFilledImage(60, 50, white)
+	fillRect(img, image.Rect(10, 15, 40, 35), red)
+	expected := transparency.RunIcon(img, 0, false)
+
+	// a sub image starts away from the origin, NRGBA goes through img.At
+	frame := newFilledImage(80, 70, white)
+	fillRect(frame, image.Rect(20, 25, 50, 45), red)
+	nrgba := image.NewNRGBA(img.Rect)
+	draw.Draw(nrgba, nrgba.Rect, img, image.Point{}, draw.Src)
+
+	for _, src := range []image.Image{frame.SubImage(image.Rect(10, 10, 70, 60)), nrgba} {
+		icon := transparency.RunIcon(src, 4, true)
+		if icon.Rect != expected.Rect {
+			t.Fatalf("%T: expected icon %v, got %v", src, expected.Rect, icon.Rect)
+		}
+		for i := range icon.Pix {
+			if icon.Pix[i] != expected.Pix[i] {
+				t.Fatalf("%T: icons differ at byte %d", src, i)
+			}
+		}
+	}
+}
+
+func TestTranslucentPixels(t *testing.T) {
+	// a half transparent square keeps its alpha through every reader
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 50, 50))
+	draw.Draw(nrgba, nrgba.Rect, image.NewUniform(white), image.Point{}, draw.Src)
+	draw.Draw(nrgba, image.Rect(10, 10, 30, 30), image.NewUniform(color.NRGBA{200, 20, 20, 128}),
+		image.Point{}, draw.Src)
+	rgba := image.NewRGBA(nrgba.Rect)
+	draw.Draw(rgba, rgba.Rect, nrgba, image.Point{}, draw.Src)
+
+	expected := color.RGBA{100, 10, 10, 128}
+	for _, src := range []image.Image{nrgba, rgba} {
+		for _, chunks := range []int{0, 4} {
+			icon := transparency.RunIcon(src, chunks, chunks > 0)
+			if icon.Rect.Dx() != 19 || icon.Rect.Dy() != 19 {
+				t.Fatalf("%T: expected the square, got %v", src, icon.Rect)
+			}
+			if actual := icon.RGBAAt(5, 5); actual != expected {
+				t.Fatalf("%T: expected %v, got %v", src, expected, actual)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if _, err := transparency.RunIconTiled(context.Background(), transparency.NewImageTileReader(nrgba), &out,
+		transparency.Options{TileWidth: 16, TileHeight: 16}); err != nil {
+		t.Fatal(err)
+	}
+	icon, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the png stores straight alpha, allow for the rounding going back
+	actual := color.RGBAModel.Convert(icon.At(5, 5)).(color.RGBA)
+	if actual.A != expected.A || absDiff(actual.R, expected.R) > 1 || absDiff(actual.G, expected.G) > 1 ||
+		absDiff(actual.B, expected.B) > 1 {
+		t.Fatalf("tiled: expected %v, got %v", expected, actual)
+	}
+}
+
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+func TestTiledPipeline(t *testing.T) {
+	// shapes straddling tile seams and corners, with a diagonal across a corner
+	img := newFilledImage(200, 150, white)
+	fillRect(img, image.Rect(20, 20, 170, 40), red)
+	fillRect(img, image.Rect(20, 40, 40, 130), red)
+	fillRect(img, image.Rect(100, 70, 140, 120), blue)
+	for i := 0; i < 25; i++ {
+		img.Set(140+i, 120+i, blue)
+	}
+
+	ppm := filepath.Join(t.TempDir(), "scan.ppm")
+	file, err := os.Create(ppm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := transparency.WritePPM(file, img); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	reader, err := transparency.OpenPPM(ppm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	for _, opts := range []transparency.Options{
+		{TileWidth: 32, TileHeight: 27},
+		{TileWidth: 64, TileHeight: 64, Connectivity: transparency.FourConnected},
+		{TileWidth: 45, Labeling: transparency.TwoPassLabeling, TempDir: t.TempDir()},
+	} {
+		expected := transparency.RunIconWithOptions(img, transparency.Options{Connectivity: opts.Connectivity})
+
+		for _, src := range []transparency.TileReader{reader, transparency.NewImageTileReader(img)} {
+			var out bytes.Buffer
+			res, err := transparency.RunIconTiled(context.Background(), src, &out, opts)
+			if err != nil {
+				t.Fatalf("%+v: %v", opts, err)
+			}
+
+			if len(res.Components) != len(expected.Components) {
+				t.Fatalf("%+v: expected %d components, got %d", opts, len(expected.Components), len(res.Components))
+			}
+			found := map[image.Rectangle]transparency.Component{}
+			for _, c := range res.Components {
+				found[c.Bounds] = c
+			}
+			for _, c := range expected.Components {
+				actual := found[c.Bounds]
+				if actual.Pixels != c.Pixels || actual.Perimeter != c.Perimeter ||
+					actual.CentroidX != c.CentroidX || actual.CentroidY != c.CentroidY ||
+					actual.TouchesBorder != c.TouchesBorder {
+					t.Fatalf("%+v: expected component %+v, got %+v", opts, c, actual)
+				}
+			}
+
+			icon, err := png.Decode(&out)
+			if err != nil {
+				t.Fatalf("%+v: %v", opts, err)
+			}
+			if icon.Bounds() != expected.Icon.Rect {
+				t.Fatalf("%+v: expected icon %v, got %v", opts, expected.Icon.Rect, icon.Bounds())
+			}
+			for y := 0; y < icon.Bounds().Dy(); y++ {
+				for x := 0; x < icon.Bounds().Dx(); x++ {
+					r1, g1, b1, a1 := icon.At(x, y).RGBA()
+					r2, g2, b2, a2 := expected.Icon.At(x, y).RGBA()
+					if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+						t.Fatalf("%+v: pixel %d,%d expected %v, got %v", opts, x, y,
+							expected.Icon.At(x, y), icon.At(x, y))
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestTiledEdgeCases(t *testing.T) {
+	// nothing but background
+	img := newFilledImage(40, 40, white)
+	var out bytes.Buffer
+	res, err := transparency.RunIconTiled(context.Background(), transparency.NewImageTileReader(img), &out,
+		transparency.Options{TileWidth: 16, TileHeight: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Selected != -1 || out.Len() != 0 {
+		t.Fatalf("expected no icon and nothing written, got %d and %d bytes", res.Selected, out.Len())
+	}
+
+	calibration := transparency.DefaultCalibration()
+	for _, opts := range []transparency.Options{
+		{Debug: true},
+		{MinComponentArea: 20, AbsorbSpeckles: true},
+		{Chunks: 4},
+		{Chunks: transparency.AutoChunks},
+		{ChunkRows: 2},
+		{ChunkCols: 2},
+		{Threaded: true},
+		{Workers: 2},
+		{Calibration: &calibration},
+	} {
+		if _, err := transparency.RunIconTiled(context.Background(), transparency.NewImageTileReader(img),
+			&out, opts); err == nil {
+			t.Fatalf("%+v: expected the option to be rejected", opts)
+		}
+	}
+}
+
+func TestAutoChunks(t *testing.T) {
+	img := newFilledImage(60, 60, white)
+	fillRect(img, image.Rect(10, 10, 50, 50), red)
+
+	calibration := transparency.Calibration{ChunkedPixels: 1000, ThreadedPixels: 1000, PixelsPerChunk: 400}
+	fileName := filepath.Join(t.TempDir(), "calibration.json")
+	if err := calibration.Save(fileName); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := transparency.LoadCalibration(fileName)
+	if err != nil || loaded != calibration {
+		t.Fatalf("expected %+v back, got %+v (%v)", calibration, loaded, err)
+	}
+
+	res := transparency.RunIconWithOptions(img, transparency.Options{
+		Chunks:      transparency.AutoChunks,
+		Calibration: &loaded,
+	})
+	threaded := runtime.GOMAXPROCS(0) > 1
+	if res.Chunks < 9 || res.Threaded != threaded {
+		t.Fatalf("expected at least 9 chunks, threaded %v, got %d chunks, threaded %v",
+			threaded, res.Chunks, res.Threaded)
+	}
+	if res.Icon.Rect.Dx() != 39 || res.Icon.Rect.Dy() != 39 {
+		t.Fatalf("expected a 39x39 icon, got %v", res.Icon.Rect)
+	}
+
+	// the threading crossover was measured with another core count
+	moved := loaded
+	moved.Cores = runtime.GOMAXPROCS(0) + 1
+	res = transparency.RunIconWithOptions(img, transparency.Options{
+		Chunks:      transparency.AutoChunks,
+		Calibration: &moved,
+	})
+	if res.Chunks < 9 || res.Threaded {
+		t.Fatalf("expected chunked labeling without threads, got %d chunks, threaded %v", res.Chunks, res.Threaded)
+	}
+
+	// too small to be worth chunking
+	loaded.ChunkedPixels = 10000
+	res = transparency.RunIconWithOptions(img, transparency.Options{
+		Chunks:      transparency.AutoChunks,
+		Calibration: &loaded,
+	})
+	if res.Chunks != 0 || res.Threaded {
+		t.Fatalf("expected sequential labeling, got %d chunks, threaded %v", res.Chunks, res.Threaded)
+	}
+}
+
+func TestDeterministicLabels(t *testing.T) {
+	img := newFilledImage(120, 90, white)
+	for i := 0; i < 6; i++ {
+		fillRect(img, image.Rect(5+i*19, 5+i*13, 20+i*19, 25+i*13), red)
+	}
+	for i := 0; i < 40; i++ {
+		img.Set(20+2*i, 80-i, blue)
+	}
+
+	for _, labeling := range []transparency.LabelingAlgorithm{transparency.DFSLabeling, transparency.TwoPassLabeling} {
+		expected := transparency.RunIconWithOptions(img, transparency.Options{Chunks: 16, Labeling: labeling})
+		opts := transparency.Options{Chunks: 16, Threaded: true, Workers: 4, Labeling: labeling}
+		for run := 0; run < 10; run++ {
+			res := transparency.RunIconWithOptions(img, opts)
+			if len(res.Components) != len(expected.Components) || res.Selected != expected.Selected {
+				t.Fatalf("%v run %d: expected %d components (%d selected), got %d (%d)", labeling, run,
+					len(expected.Components), expected.Selected, len(res.Components), res.Selected)
+			}
+			for i, c := range expected.Components {
+				if res.Components[i].Label != c.Label || res.Components[i].Bounds != c.Bounds {
+					t.Fatalf("%v run %d: component %d expected label %d at %v, got %d at %v", labeling, run,
+						i, c.Label, c.Bounds, res.Components[i].Label, res.Components[i].Bounds)
+				}
+			}
+		}
+	}
+}
+
+func TestConcurrentSeamMerge(t *testing.T) {
+	// a comb whose teeth only join up along the bottom, across many seams
+	img := newFilledImage(256, 256, white)
+	for x := 4; x < 252; x += 6 {
+		fillRect(img, image.Rect(x, 4, x+3, 240), red)
+	}
+	fillRect(img, image.Rect(4, 240, 252, 250), red)
+	for i := 0; i < 100; i++ {
+		img.Set(10+i, 252-i/50, blue)
+	}
+
+	for _, connectivity := range []transparency.Connectivity{transparency.FourConnected, transparency.EightConnected} {
+		serial := transparency.RunIconWithOptions(img, transparency.Options{
+			Chunks: 64, Threaded: true, Workers: 1, Connectivity: connectivity,
+		})
+		for _, workers := range []int{2, 8} {
+			concurrent := transparency.RunIconWithOptions(img, transparency.Options{
+				Chunks: 64, Threaded: true, Workers: workers, Connectivity: connectivity,
+			})
+			if len(concurrent.Components) != len(serial.Components) {
+				t.Fatalf("%d workers: expected %d components, got %d", workers,
+					len(serial.Components), len(concurrent.Components))
+			}
+			for i, c := range serial.Components {
+				actual := concurrent.Components[i]
+				if actual.Label != c.Label || actual.Pixels != c.Pixels || actual.Bounds != c.Bounds ||
+					actual.Perimeter != c.Perimeter ||
+					actual.CentroidX != c.CentroidX || actual.CentroidY != c.CentroidY {
+					t.Fatalf("%d workers: component %d expected %+v, got %+v", workers, i, c, actual)
+				}
+			}
+			if concurrent.Icon.Rect != serial.Icon.Rect {
+				t.Fatalf("%d workers: expected icon %v, got %v", workers, serial.Icon.Rect, concurrent.Icon.Rect)
+			}
+		}
+	}
+}
+
+func TestDebugImage(t *testing.T) {
+	img := newFilledImage(80, 80, white)
+	fillRect(img, image.Rect(10, 10, 50, 50), red)
+	fillRect(img, image.Rect(60, 60, 70, 70), blue)
+
+	if res := transparency.RunIconWithOptions(img, transparency.Options{}); res.Debug != nil {
+		t.Fatalf("expected no debug image unless asked for")
+	}
+
+	res := transparency.RunIconWithOptions(img, transparency.Options{Chunks: 4, Debug: true})
+	if res.Debug == nil || res.Debug.Rect != img.Rect {
+		t.Fatalf("expected a debug image the size of the input")
+	}
+
+	for _, check := range []struct {
+		p        image.Point
+		expected color.RGBA
+	}{
+		{image.Pt(5, 5), color.RGBA{32, 32, 32, 255}},     // background
+		{image.Pt(5, 40), color.RGBA{255, 255, 255, 255}}, // chunk seam
+		{image.Pt(60, 60), color.RGBA{255, 220, 0, 255}},  // corner of the other component's box
+		{image.Pt(10, 10), color.RGBA{255, 0, 0, 255}},    // corner of the icon's box
+	} {
+		if actual := res.Debug.RGBAAt(check.p.X, check.p.Y); actual != check.expected {
+			t.Fatalf("expected %v at %v, got %v", check.expected, check.p, actual)
+		}
+	}
+
+	// the icon is the same color across the seams, the other component is dimmed
+	icon := res.Debug.RGBAAt(20, 20)
+	if res.Debug.RGBAAt(45, 45) != icon || res.Debug.RGBAAt(20, 45) != icon {
+		t.Fatalf("expected the merged icon to share one color across the chunks")
+	}
+	other := res.Debug.RGBAAt(65, 65)
+	if other == icon || int(other.R)+int(other.G)+int(other.B) >= int(icon.R)+int(icon.G)+int(icon.B) {
+		t.Fatalf("expected the other component dimmer than the icon, got %v and %v", other, icon)
+	}
+}
+
 func BechmarkIcon(b *testing.B) {
 	img := transparency.ReadFile("clownfish")
 	for i := 0; i < b.N; i++ {
 		transparency.RunIcon(img, 0, false)
 	}
 }
+
+func BenchmarkLabeling(b *testing.B) {
+	img := transparency.ReadFile("earthBg")
+	for _, labeling := range []transparency.LabelingAlgorithm{
+		transparency.DFSLabeling,
+		transparency.TwoPassLabeling,
+	} {
+		for _, opts := range []transparency.Options{
+			{Labeling: labeling},
+			{Labeling: labeling, Chunks: 4, Threaded: true},
+		} {
+			b.Run(fmt.Sprintf("%v/chunks=%d", labeling, opts.Chunks), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					transparency.RunIconWithOptions(img, opts)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package transparency
+
+import (
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"math"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// AutoChunks as Options.Chunks (or the chunks passed to RunIcon) picks
+// sequential, chunked or threaded labeling and the chunk count from the image
+// size and core count, using Options.Calibration
+const AutoChunks = -1
+
+// maxAutoChunks caps the grid picked by AutoChunks
+const maxAutoChunks = 1024
+
+// Calibration holds the crossover points AutoChunks decides with, measured on
+// this machine by Calibrate or DefaultCalibration when there's no measurement
+type Calibration struct {
+	// ChunkedPixels is the image size (width*height) from which chunking pays off
+	ChunkedPixels int `json:"chunkedPixels"`
+	// ThreadedPixels is the image size from which labeling the chunks in
+	// parallel beats doing them one after the other
+	ThreadedPixels int `json:"threadedPixels"`
+	// PixelsPerChunk sizes the grid, the chunk count is pixels/PixelsPerChunk
+	PixelsPerChunk int `json:"pixelsPerChunk"`
+	// Cores is GOMAXPROCS when the calibration ran, ThreadedPixels only holds
+	// for that many cores and the default is used on any other count
+	// (0 trusts it everywhere)
+	Cores int `json:"cores"`
+}
+
+// DefaultCalibration is what AutoChunks uses until Calibrate has been run
+// setting up chunks and goroutines costs more than it saves under a few megapixels
+func DefaultCalibration() Calibration {
+	return Calibration{
+		ChunkedPixels:  4 << 20,
+		ThreadedPixels: 4 << 20,
+		PixelsPerChunk: 512 * 512,
+		Cores:          runtime.GOMAXPROCS(0),
+	}
+}
+
+// LoadCalibration reads a calibration saved by Calibration.Save
+func LoadCalibration(fileName string) (Calibration, error) {
+	var c Calibration
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// Save writes the calibration as json
+func (c Calibration) Save(fileName string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, append(data, '\n'), 0644)
+}
+
+// plan picks the chunk count (0 for sequential) and threading for an image
+func (c Calibration) plan(pixels, cores int) (int, bool) {
+	if c.ChunkedPixels <= 0 || pixels < c.ChunkedPixels {
+		return 0, false
+	}
+
+	chunks := 4
+	if c.PixelsPerChunk > 0 {
+		chunks = max(2, min(pixels/c.PixelsPerChunk, maxAutoChunks))
+	}
+
+	threadedPixels := c.ThreadedPixels
+	if c.Cores > 0 && c.Cores != cores {
+		// the calibration ran on another core count, its threading crossover says nothing here
+		threadedPixels = DefaultCalibration().ThreadedPixels
+	}
+	threaded := cores > 1 && threadedPixels > 0 && pixels >= threadedPixels
+	if threaded {
+		// give every core at least one chunk
+		chunks = max(chunks, cores)
+	}
+	return chunks, threaded
+}
+
+// autoChunks resolves AutoChunks into the chunking to run with
+func (opts Options) autoChunks(width, height int) Options {
+	if opts.Chunks != AutoChunks {
+		return opts
+	}
+
+	calibration := DefaultCalibration()
+	if opts.Calibration != nil {
+		calibration = *opts.Calibration
+	}
+	opts.Chunks, opts.Threaded = calibration.plan(width*height, runtime.GOMAXPROCS(0))
+	return opts
+}
+
+// calibrationChunks are the chunk counts Calibrate tries
+var calibrationChunks = []int{4, 16, 64, 256}
+
+// calibrationSample is the fastest time of each mode at one image size
+type calibrationSample struct {
+	pixels     int
+	sequential time.Duration
+	chunked    time.Duration
+	threaded   time.Duration
+	// bestChunks is the fastest chunk count when threaded
+	bestChunks int
+}
+
+// Calibrate times sequential, chunked and threaded labeling over the images
+// and crops of them (a quarter and half of each side) to find the crossovers
+// each measurement is the fastest of runs
+func Calibrate(images []image.Image, runs int) Calibration {
+	runs = max(runs, 1)
+	var samples []calibrationSample
+	for _, img := range images {
+		bounds := img.Bounds()
+		for _, fraction := range []float64{0.25, 0.5, 1} {
+			crop := image.Rect(0, 0, int(float64(bounds.Dx())*fraction), int(float64(bounds.Dy())*fraction)).
+				Add(bounds.Min)
+			samples = append(samples, calibrationSampleOf(subImage(img, crop), runs))
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].pixels < samples[j].pixels
+	})
+
+	calibration := DefaultCalibration()
+	calibration.ChunkedPixels = crossover(samples, func(s calibrationSample) bool {
+		return min(int(s.chunked), int(s.threaded)) < int(s.sequential)
+	})
+	calibration.ThreadedPixels = crossover(samples, func(s calibrationSample) bool {
+		return s.threaded < s.chunked && s.threaded < s.sequential
+	})
+	if len(samples) > 0 {
+		largest := samples[len(samples)-1]
+		calibration.PixelsPerChunk = max(1, largest.pixels/largest.bestChunks)
+	}
+	return calibration
+}
+
+// crossover is the smallest sample size from which faster holds for every
+// bigger sample, math.MaxInt32 when it never does
+func crossover(samples []calibrationSample, faster func(calibrationSample) bool) int {
+	point := math.MaxInt32
+	for i := len(samples) - 1; i >= 0 && faster(samples[i]); i-- {
+		point = samples[i].pixels
+	}
+	return point
+}
+
+// calibrationSampleOf times every mode on one image
+func calibrationSampleOf(img image.Image, runs int) calibrationSample {
+	sample := calibrationSample{
+		pixels:     img.Bounds().Dx() * img.Bounds().Dy(),
+		sequential: fastest(img, Options{}, runs),
+		chunked:    time.Duration(math.MaxInt64),
+		threaded:   time.Duration(math.MaxInt64),
+		bestChunks: calibrationChunks[0],
+	}
+
+	for _, chunks := range calibrationChunks {
+		if chunked := fastest(img, Options{Chunks: chunks}, runs); chunked < sample.chunked {
+			sample.chunked = chunked
+		}
+		if threaded := fastest(img, Options{Chunks: chunks, Threaded: true}, runs); threaded < sample.threaded {
+			sample.threaded = threaded
+			sample.bestChunks = chunks
+		}
+	}
+	return sample
+}
+
+// fastest is the quickest of runs labelings of the image
+func fastest(img image.Image, opts Options, runs int) time.Duration {
+	best := time.Duration(math.MaxInt64)
+	for run := 0; run < runs; run++ {
+		start := time.Now()
+		RunIconWithOptions(img, opts)
+		if elapsed := time.Since(start); elapsed < best {
+			best = elapsed
+		}
+	}
+	return best
+}
+
+// subImage crops the image, copying it when it can't be cropped in place
+func subImage(img image.Image, r image.Rectangle) image.Image {
+	tile, _ := NewImageTileReader(img).ReadTile(r)
+	return tile
+}
@@ -0,0 +1,199 @@
+package transparency
+
+import (
+	"fmt"
+	"math"
+)
+
+// quantizeBits is how many of the high bits of each channel pick a bucket
+// 5 bits gives 32 levels per channel, 32768 buckets in total
+const quantizeBits = 5
+
+const bucketLevels = 1 << quantizeBits
+
+// Background is the detected background color (16 bits per channel, same as
+// color.RGBA) and the spread (RMS distance to Color) of the cluster behind it
+type Background struct {
+	Color  [3]uint32
+	Spread float64
+}
+
+type colorBucket struct {
+	count int
+	sum   [3]uint64
+	sumSq [3]uint64
+}
+
+// colorHistogram counts colors in coarse RGB buckets so the jpeg compression
+// noise doesn't split a single background shade into hundreds of colors
+type colorHistogram struct {
+	buckets []colorBucket
+}
+
+func newColorHistogram() *colorHistogram {
+	return &colorHistogram{
+		buckets: make([]colorBucket, bucketLevels*bucketLevels*bucketLevels),
+	}
+}
+
+// bucketIndex maps a 16 bit channel triple to its 1d bucket index
+func bucketIndex(red, green, blue uint32) int {
+	shift := 16 - quantizeBits
+	return int(red>>shift)*bucketLevels*bucketLevels +
+		int(green>>shift)*bucketLevels + int(blue>>shift)
+}
+
+// add puts the color in its bucket, tracking sums for the centroid and spread
+func (h *colorHistogram) add(c [3]uint32) {
+	bucket := &h.buckets[bucketIndex(c[0], c[1], c[2])]
+	bucket.count++
+	for i, channel := range c {
+		bucket.sum[i] += uint64(channel)
+		bucket.sumSq[i] += uint64(channel) * uint64(channel)
+	}
+}
+
+// addMatrix adds the pixels of a matrix sitting at (left, top) in a width x height
+// image, with BorderBackground only the pixels within borderWidth of the edge vote
+func (h *colorHistogram) addMatrix(matrix *pixelMatrix, left, top, width, height int,
+	strategy BackgroundStrategy, borderWidth int) {
+	for row := 0; row < matrix.height; row++ {
+		for col := 0; col < matrix.width; col++ {
+			if strategy == BorderBackground && !inBorder(left+col, top+row, width, height, borderWidth) {
+				continue
+			}
+			h.add(matrix.rgb(row*matrix.width + col))
+		}
+	}
+}
+
+// palette is the paletteSize most popular clusters, only the dominant one
+// when paletteSize is 1 or less
+func (h *colorHistogram) palette(paletteSize int) []Background {
+	if paletteSize > 1 {
+		return h.topClusters(paletteSize)
+	}
+	return []Background{h.dominant()}
+}
+
+// dominant finds the most popular bucket and returns the centroid of it
+// plus its direct neighbors - a shade sitting on a bucket edge is split in two
+func (h *colorHistogram) dominant() Background {
+	return h.topClusters(1)[0]
+}
+
+// topClusters returns the n most popular clusters, most popular first
+// each cluster is a bucket plus its neighbors, buckets are only used once
+func (h *colorHistogram) topClusters(n int) []Background {
+	used := make([]bool, len(h.buckets))
+	clusters := make([]Background, 0, n)
+
+	for len(clusters) < n {
+		maxInx := -1
+		for i := range h.buckets {
+			if used[i] || h.buckets[i].count == 0 {
+				continue
+			}
+			if maxInx == -1 || h.buckets[i].count > h.buckets[maxInx].count {
+				maxInx = i
+			}
+		}
+		if maxInx == -1 {
+			// fewer distinct colors than requested clusters
+			break
+		}
+
+		clusters = append(clusters, h.cluster(maxInx, used).background())
+	}
+
+	if len(clusters) == 0 {
+		clusters = append(clusters, Background{})
+	}
+	return clusters
+}
+
+// cluster sums the bucket at inx with its unused neighbors, marking them used
+func (h *colorHistogram) cluster(inx int, used []bool) colorBucket {
+	center := [3]int{
+		inx / (bucketLevels * bucketLevels),
+		(inx / bucketLevels) % bucketLevels,
+		inx % bucketLevels,
+	}
+
+	var cluster colorBucket
+	for dr := -1; dr <= 1; dr++ {
+		for dg := -1; dg <= 1; dg++ {
+			for db := -1; db <= 1; db++ {
+				r, g, b := center[0]+dr, center[1]+dg, center[2]+db
+				if r < 0 || g < 0 || b < 0 ||
+					r >= bucketLevels || g >= bucketLevels || b >= bucketLevels {
+					continue
+				}
+
+				neighbor := r*bucketLevels*bucketLevels + g*bucketLevels + b
+				if used[neighbor] {
+					continue
+				}
+				used[neighbor] = true
+
+				bucket := h.buckets[neighbor]
+				cluster.count += bucket.count
+				for i := 0; i < 3; i++ {
+					cluster.sum[i] += bucket.sum[i]
+					cluster.sumSq[i] += bucket.sumSq[i]
+				}
+			}
+		}
+	}
+
+	return cluster
+}
+
+// background turns the bucket sums into the mean color and its spread
+func (b colorBucket) background() Background {
+	if b.count == 0 {
+		return Background{}
+	}
+
+	var result Background
+	variance := 0.0
+	count := float64(b.count)
+	for i := 0; i < 3; i++ {
+		mean := float64(b.sum[i]) / count
+		result.Color[i] = uint32(math.Round(mean))
+		variance += float64(b.sumSq[i])/count - mean*mean
+	}
+	result.Spread = math.Sqrt(math.Max(variance, 0))
+
+	return result
+}
+
+// BackgroundStrategy picks which pixels vote for the background color
+type BackgroundStrategy int
+
+const (
+	// PopularityBackground uses the most popular color cluster in the whole image
+	PopularityBackground BackgroundStrategy = iota
+	// BorderBackground only samples a ring along the image border
+	// which works better when the icon fills most of the frame
+	BorderBackground
+)
+
+// defaultBorderWidth is the ring width in pixels when Options.BorderWidth is unset
+const defaultBorderWidth = 4
+
+func (s BackgroundStrategy) String() string {
+	switch s {
+	case PopularityBackground:
+		return "popularity"
+	case BorderBackground:
+		return "border"
+	}
+	return fmt.Sprintf("BackgroundStrategy(%d)", int(s))
+}
+
+// inBorder reports if (col, row) is within borderWidth pixels of an image edge
+func inBorder(col, row, width, height, borderWidth int) bool {
+	return row < borderWidth || row >= height-borderWidth ||
+		col < borderWidth || col >= width-borderWidth
+}
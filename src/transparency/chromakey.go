@@ -0,0 +1,141 @@
+package transparency
+
+import (
+	"image/color"
+	"math"
+)
+
+// ChromaKey classifies the background by hue, saturation and value instead of
+// the distance to a background color - shadows on a green screen keep the
+// screen's hue, they only get darker
+type ChromaKey struct {
+	// Hue is the key color in degrees (120 green, 240 blue)
+	Hue float64
+	// HueRange is how many degrees either side of Hue are keyed out
+	HueRange float64
+	// MinSaturation (0-1) keeps grays and whites with a hint of the key hue
+	MinSaturation float64
+	// MinValue (0-1) keeps near black pixels, their hue is mostly noise
+	MinValue float64
+	// Softness is the hue margin in degrees past HueRange where the alpha
+	// fades in instead of cutting hard, 0 for a hard edge
+	Softness float64
+	// Despill pulls the key color back out of the kept pixels (green fringes)
+	Despill bool
+}
+
+// GreenScreen is a ChromaKey tuned for a studio green screen
+func GreenScreen() ChromaKey {
+	return ChromaKey{
+		Hue:           120,
+		HueRange:      40,
+		MinSaturation: 0.25,
+		MinValue:      0.08,
+		Softness:      15,
+		Despill:       true,
+	}
+}
+
+// BlueScreen is a ChromaKey tuned for a studio blue screen
+func BlueScreen() ChromaKey {
+	key := GreenScreen()
+	key.Hue = 240
+	return key
+}
+
+// toHSV converts 16 bit RGB to hue in degrees, saturation and value (0-1)
+func toHSV(c [3]uint32) (float64, float64, float64) {
+	r := float64(c[0]) / 0xffff
+	g := float64(c[1]) / 0xffff
+	b := float64(c[2]) / 0xffff
+
+	maxChannel := math.Max(r, math.Max(g, b))
+	minChannel := math.Min(r, math.Min(g, b))
+	delta := maxChannel - minChannel
+
+	var hue float64
+	switch {
+	case delta == 0:
+		hue = 0
+	case maxChannel == r:
+		hue = 60 * math.Mod((g-b)/delta, 6)
+	case maxChannel == g:
+		hue = 60 * ((b-r)/delta + 2)
+	default:
+		hue = 60 * ((r-g)/delta + 4)
+	}
+	if hue < 0 {
+		hue += 360
+	}
+
+	saturation := 0.0
+	if maxChannel > 0 {
+		saturation = delta / maxChannel
+	}
+	return hue, saturation, maxChannel
+}
+
+// hueDistance is how many degrees the hue is from the key, going the short way round
+func (k *ChromaKey) hueDistance(hue float64) float64 {
+	distance := math.Abs(math.Mod(hue-k.Hue, 360))
+	if distance > 180 {
+		distance = 360 - distance
+	}
+	return distance
+}
+
+// keyable reports if the pixel is saturated and bright enough for its hue to count
+func (k *ChromaKey) keyable(saturation, value float64) bool {
+	return saturation >= k.MinSaturation && value >= k.MinValue
+}
+
+// matches reports if the pixel is part of the screen
+func (k *ChromaKey) matches(pixel [3]uint32) bool {
+	hue, saturation, value := toHSV(pixel)
+	return k.keyable(saturation, value) && k.hueDistance(hue) <= k.HueRange
+}
+
+// alpha is the opacity of a kept pixel, fading in over Softness degrees past
+// the edge of the keyed hue range
+func (k *ChromaKey) alpha(pixel [3]uint32) float64 {
+	hue, saturation, value := toHSV(pixel)
+	if k.Softness <= 0 || !k.keyable(saturation, value) {
+		return 1
+	}
+
+	past := k.hueDistance(hue) - k.HueRange
+	if past <= 0 || past >= k.Softness {
+		return 1
+	}
+	return past / k.Softness
+}
+
+// keyChannel is the RGB channel closest to the key hue (0 red, 1 green, 2 blue)
+func (k *ChromaKey) keyChannel() int {
+	return int(math.Round(k.Hue/120)) % 3
+}
+
+// despill limits the key channel to the brighter of the other two channels
+func (k *ChromaKey) despill(pixel [3]uint32) [3]uint32 {
+	channel := k.keyChannel()
+	limit := max(int(pixel[(channel+1)%3]), int(pixel[(channel+2)%3]))
+	if int(pixel[channel]) > limit {
+		pixel[channel] = uint32(limit)
+	}
+	return pixel
+}
+
+// apply returns the output color of a kept pixel with soft alpha and despill
+func (k *ChromaKey) apply(channels [3]uint32) color.Color {
+	alpha := k.alpha(channels)
+	if k.Despill {
+		channels = k.despill(channels)
+	}
+
+	return color.NRGBA64{
+		R: uint16(channels[0]),
+		G: uint16(channels[1]),
+		B: uint16(channels[2]),
+		A: uint16(math.Round(alpha * 0xffff)),
+	}
+}
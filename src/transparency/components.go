@@ -0,0 +1,384 @@
+package transparency
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"runtime"
+	"sort"
+)
+
+// labeledImage is the image after the background is detected and every
+// connected component is labeled, ready for an icon to be picked out
+type labeledImage struct {
+	width        int
+	height       int
+	matrix       *pixelMatrix
+	palette      []Background
+	classifier   *classifier
+	connectivity Connectivity
+	components   *UnionFind
+	// tiles holds the labels on disk instead of matrix for RunIconTiled
+	tiles *tileStore
+	// grid is how the image was chunked, nil when it wasn't
+	grid *chunkGrid
+}
+
+// labelImage runs the background detection and the labeling picked by opts
+func labelImage(ctx context.Context, img image.Image, opts Options) (*labeledImage, error) {
+	backgroundWidth := img.Bounds().Dx()
+	backgroundHeight := img.Bounds().Dy()
+
+	borderWidth := opts.BorderWidth
+	if borderWidth <= 0 {
+		borderWidth = defaultBorderWidth
+	}
+
+	palette, pixelMatrix, err := findBackgroundColor(ctx, img, backgroundWidth, backgroundHeight,
+		opts.Background, borderWidth, opts.PaletteSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Palette) > 0 {
+		// caller knows the background colors, skip the detected ones
+		palette = paletteBackgrounds(opts.Palette)
+	}
+	backgroundClassifier, err := newClassifier(ctx, opts, palette, pixelMatrix,
+		backgroundWidth, backgroundHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	connectivity := opts.Connectivity
+	if connectivity == 0 {
+		connectivity = EightConnected
+	}
+
+	labelChunk := opts.Labeling.labeler()
+	var components *UnionFind
+	var chunks *chunkGrid
+	if grid, ok := opts.chunkGrid(backgroundWidth, backgroundHeight); ok {
+		chunks = &grid
+		// run by chunking
+		if opts.Threaded {
+			// run chunks in parallel
+			workers := opts.Workers
+			if workers <= 0 {
+				workers = runtime.GOMAXPROCS(0)
+			}
+			components, err = findIconChunkThread(ctx, backgroundWidth, backgroundHeight, pixelMatrix,
+				backgroundClassifier, grid, workers, connectivity, labelChunk)
+		} else {
+			components, err = findIconChunk(ctx, backgroundWidth,
+				backgroundHeight, pixelMatrix, backgroundClassifier, grid, connectivity, labelChunk)
+		}
+	} else {
+		components, err = findIcon(ctx, backgroundWidth,
+			backgroundHeight, pixelMatrix, backgroundClassifier, connectivity, labelChunk)
+	}
+	if err != nil {
+		return nil, err
+	}
+	exposedSides(pixelMatrix, func(label, sides int) {
+		components.area[components.Root(label)].totals.perimeter += sides
+	})
+
+	return &labeledImage{
+		width:        backgroundWidth,
+		height:       backgroundHeight,
+		matrix:       pixelMatrix,
+		palette:      palette,
+		classifier:   backgroundClassifier,
+		connectivity: connectivity,
+		components:   components,
+		grid:         chunks,
+	}, nil
+}
+
+// paletteBackgrounds turns the caller's Options.Palette into backgrounds
+func paletteBackgrounds(colors []color.Color) []Background {
+	palette := make([]Background, len(colors))
+	for i, c := range colors {
+		r, g, b, _ := c.RGBA()
+		palette[i].Color = [3]uint32{r, g, b}
+	}
+	return palette
+}
+
+// componentList describes every merged component for a SelectionPolicy
+// sorted by the first label of each component (scan order of the chunks)
+// alongside the labels that merged into each one
+func (l *labeledImage) componentList() ([]Component, []map[int]bool) {
+	sets := componentSets(l.components)
+	roots := make([]int, 0, len(sets))
+	firstLabel := make(map[int]int, len(sets))
+	for root, labels := range sets {
+		roots = append(roots, root)
+		firstLabel[root] = MaxInt
+		for label := range labels {
+			firstLabel[root] = min(firstLabel[root], label)
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool {
+		return firstLabel[roots[i]] < firstLabel[roots[j]]
+	})
+
+	components := make([]Component, len(roots))
+	labelSets := make([]map[int]bool, len(roots))
+	for i, root := range roots {
+		components[i] = l.component(root)
+		labelSets[i] = sets[root]
+	}
+	return components, labelSets
+}
+
+// component fills in the statistics of the merged component at root
+func (l *labeledImage) component(root int) Component {
+	area := l.components.area[root]
+	dimensions := area.totalDimensions
+	pixels := float64(area.totalPixels)
+
+	return Component{
+		Label:     root,
+		Pixels:    area.totalPixels,
+		Bounds:    dimensionsRect(dimensions),
+		CentroidX: float64(area.totals.sumX) / pixels,
+		CentroidY: float64(area.totals.sumY) / pixels,
+		Perimeter: area.totals.perimeter,
+		MeanColor: color.RGBA64{
+			R: uint16(float64(area.totals.sumColor[0]) / pixels),
+			G: uint16(float64(area.totals.sumColor[1]) / pixels),
+			B: uint16(float64(area.totals.sumColor[2]) / pixels),
+			A: 0xffff,
+		},
+		TouchesBorder: dimensions[0] == 0 || dimensions[2] == 0 ||
+			dimensions[1] == l.height-1 || dimensions[3] == l.width-1,
+		contains: l.containsFunc(root),
+	}
+}
+
+// containsFunc checks the label under a pixel against the component root
+func (l *labeledImage) containsFunc(root int) func(image.Point) bool {
+	return func(p image.Point) bool {
+		if p.X < 0 || p.Y < 0 || p.X >= l.width || p.Y >= l.height {
+			return false
+		}
+		label := l.labelAt(p.X, p.Y)
+		return label > 0 && l.components.Root(label) == root
+	}
+}
+
+// labelAt is the label of the pixel at (col, row)
+func (l *labeledImage) labelAt(col, row int) int {
+	if l.tiles != nil {
+		return l.tiles.labelAt(col, row)
+	}
+	return l.matrix.label(row*l.width + col)
+}
+
+// selectIcon runs the policy over the components and returns the dimensions
+// and labels of the chosen icon, nothing is chosen when there are no components
+// components lists everything that was labeled, choice indexes it (-1 for none)
+// components under Options.MinComponentArea are speckles, they can't be picked
+// and are either dropped or absorbed into the icon (Options.AbsorbSpeckles)
+func (l *labeledImage) selectIcon(opts Options) (iconDimensions [4]int,
+	iconComponents map[int]bool, components []Component, choice int) {
+	policy := opts.Selection
+	if policy == nil {
+		policy = LargestArea()
+	}
+
+	components, labelSets := l.componentList()
+	iconComponents = map[int]bool{}
+	var candidates []Component
+	var candidateInx []int
+	for i, c := range components {
+		if c.Pixels >= opts.MinComponentArea {
+			candidates = append(candidates, c)
+			candidateInx = append(candidateInx, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return iconDimensions, iconComponents, components, -1
+	}
+
+	choice = policy(candidates, image.Rect(0, 0, l.width, l.height))
+	if choice < 0 || choice >= len(candidates) {
+		return iconDimensions, iconComponents, components, -1
+	}
+
+	// the icon's hashset holds every chunk label that merged into it
+	// eg chunk1 had component65 that merged with chunk2's component800
+	// the result icon's component hashset is {65, 800}
+	iconDimensions = l.components.area[candidates[choice].Label].totalDimensions
+	iconComponents = labelSets[candidateInx[choice]]
+	choice = candidateInx[choice]
+	if !opts.AbsorbSpeckles {
+		return iconDimensions, iconComponents, components, choice
+	}
+
+	// islands in the icon's holes, or touching it at a corner when it's four
+	// connected, become part of it - anything reaching out of the icon's box
+	// stays out so the crop doesn't grow
+	mask := newIconMask(l.matrix, iconDimensions, iconComponents, l.width)
+	regions := mask.outside(backgroundNeighbors(l.connectivity))
+	absorbed := make(map[int]bool, len(iconComponents))
+	for label := range iconComponents {
+		absorbed[label] = true
+	}
+	for i, c := range components {
+		speckleDimensions := l.components.area[c.Label].totalDimensions
+		if c.Pixels >= opts.MinComponentArea || !dimensionsWithin(speckleDimensions, iconDimensions) ||
+			!l.touchesIcon(mask, regions, labelSets[i], speckleDimensions) {
+			continue
+		}
+
+		for label := range labelSets[i] {
+			absorbed[label] = true
+		}
+	}
+
+	return iconDimensions, absorbed, components, choice
+}
+
+// dimensionsWithin reports if the [top, bottom, left, right] box inner lies inside outer
+func dimensionsWithin(inner, outer [4]int) bool {
+	return inner[0] >= outer[0] && inner[1] <= outer[1] && inner[2] >= outer[2] && inner[3] <= outer[3]
+}
+
+// touchesIcon reports if a pixel of the labels sits in a hole of the mask or
+// next to one of its pixels
+func (l *labeledImage) touchesIcon(mask *iconMask, regions []int, labels map[int]bool, dimensions [4]int) bool {
+	for row := dimensions[0]; row <= dimensions[1]; row++ {
+		for col := dimensions[2]; col <= dimensions[3]; col++ {
+			if !labels[l.matrix.label(row*l.width+col)] {
+				continue
+			}
+			if mask.enclosed(col, row, regions) {
+				return true
+			}
+			for _, offset := range eightNeighbors {
+				if mask.at(col+offset[0], row+offset[1]) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// render builds the transparent image of the icon made of the labels and
+// returns where it was cropped from, morphology can move that off the labels'
+// bounding box - inclusive crops every row and column of it, otherwise it
+// keeps RunIcon's crop
+func (l *labeledImage) render(ctx context.Context, iconDimensions [4]int,
+	iconComponents map[int]bool, opts Options, inclusive bool) (*image.RGBA, image.Rectangle, error) {
+	mask := newIconMask(l.matrix, iconDimensions, iconComponents, l.width)
+	if len(opts.Morphology) > 0 {
+		mask = mask.applyMorphology(opts.Morphology, l.width, l.height)
+		iconDimensions = mask.dimensions()
+	}
+	if opts.BorderConnected {
+		mask.fillHoles(l.connectivity, -1)
+	} else if opts.MaxHoleArea > 0 {
+		mask.fillHoles(l.connectivity, opts.MaxHoleArea)
+	}
+
+	crop := legacyCropRect(iconDimensions)
+	if inclusive {
+		crop = dimensionsRect(iconDimensions)
+	}
+	icon, err := buildTransparentImage(ctx, l.matrix, crop, mask, l.width, opts.ChromaKey)
+	return icon, crop, err
+}
+
+// legacyCropRect is the area RunIcon has always cropped to, one short of the
+// bottom row and right column - the golden files were made with it
+func legacyCropRect(dimensions [4]int) image.Rectangle {
+	return image.Rect(dimensions[2], dimensions[0],
+		max(dimensions[3], dimensions[2]), max(dimensions[1], dimensions[0]))
+}
+
+// dimensionsRect turns the inclusive [top, bottom, left, right] into the
+// rectangle holding every pixel of the component
+func dimensionsRect(dimensions [4]int) image.Rectangle {
+	return image.Rect(dimensions[2], dimensions[0], dimensions[3]+1, dimensions[1]+1)
+}
+
+// componentSets groups every label under the root of its merged component
+func componentSets(unionFindParents *UnionFind) map[int]map[int]bool {
+	sets := make(map[int]map[int]bool)
+	for i := 1; i < len(unionFindParents.root); i++ {
+		if unionFindParents.area[unionFindParents.Root(i)].totalPixels == 0 {
+			// label was handed out but never used
+			continue
+		}
+
+		root := unionFindParents.Root(i)
+		if sets[root] == nil {
+			sets[root] = make(map[int]bool)
+		}
+		sets[root][i] = true
+	}
+	return sets
+}
+
+// Icon is a single component cropped out of the source image
+type Icon struct {
+	Image *image.RGBA
+	// Bounds is where the crop sits in the source image
+	Bounds image.Rectangle
+	// Pixels counts the pixels of Image that aren't fully transparent, it can
+	// differ from Component.Pixels once Morphology or hole filling ran
+	Pixels    int
+	Component Component
+}
+
+// ExtractIcons returns every component with at least minPixels pixels as its
+// own transparent icon, largest first - eg slicing a sprite sheet in one run
+func ExtractIcons(img image.Image, opts Options, minPixels int) []Icon {
+	ctx := context.Background()
+	labeled, err := labelImage(ctx, img, opts.autoChunks(img.Bounds().Dx(), img.Bounds().Dy()))
+	check(err)
+
+	var icons []Icon
+	for root, labels := range componentSets(labeled.components) {
+		area := labeled.components.area[root]
+		if area.totalPixels < minPixels {
+			continue
+		}
+
+		iconImage, crop, err := labeled.render(ctx, area.totalDimensions, labels, opts, true)
+		check(err)
+		icons = append(icons, Icon{
+			Image:     iconImage,
+			Bounds:    crop,
+			Pixels:    visiblePixels(iconImage),
+			Component: labeled.component(root),
+		})
+	}
+
+	// map order is random, keep the output stable
+	sort.Slice(icons, func(i, j int) bool {
+		if icons[i].Pixels != icons[j].Pixels {
+			return icons[i].Pixels > icons[j].Pixels
+		}
+		if icons[i].Bounds.Min.Y != icons[j].Bounds.Min.Y {
+			return icons[i].Bounds.Min.Y < icons[j].Bounds.Min.Y
+		}
+		return icons[i].Bounds.Min.X < icons[j].Bounds.Min.X
+	})
+
+	return icons
+}
+
+// visiblePixels counts the pixels that aren't fully transparent
+func visiblePixels(img *image.RGBA) int {
+	count := 0
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0 {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,107 @@
+package transparency
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+var (
+	debugBackground = color.RGBA{32, 32, 32, 255}
+	debugGrid       = color.RGBA{255, 255, 255, 255}
+	debugBox        = color.RGBA{255, 220, 0, 255}
+	debugSelected   = color.RGBA{255, 0, 0, 255}
+)
+
+// debugImage draws the label map behind Result.Debug
+// every merged component gets its own color from its union find root, so
+// chunk labels that merged share a color and a missed merge shows up as a
+// color change along a chunk seam
+func (l *labeledImage) debugImage(iconDimensions [4]int, iconComponents map[int]bool,
+	selected bool) *image.RGBA {
+	debug := image.NewRGBA(image.Rect(0, 0, l.width, l.height))
+
+	for inx, label := range l.matrix.labels {
+		c := debugBackground
+		if label > 0 {
+			c = falseColor(l.components.Root(int(label)))
+			if !iconComponents[int(label)] {
+				c = color.RGBA{c.R / 3, c.G / 3, c.B / 3, 255}
+			}
+		}
+		debug.SetRGBA(inx%l.width, inx/l.width, c)
+	}
+
+	if l.grid != nil {
+		for _, row := range l.grid.rowStarts[1:l.grid.rows] {
+			drawLine(debug, image.Rect(0, row, l.width, row+1), debugGrid)
+		}
+		for _, col := range l.grid.colStarts[1:l.grid.cols] {
+			drawLine(debug, image.Rect(col, 0, col+1, l.height), debugGrid)
+		}
+	}
+
+	for root := range componentSets(l.components) {
+		drawBox(debug, l.components.area[root].totalDimensions, debugBox)
+	}
+	if selected {
+		drawBox(debug, iconDimensions, debugSelected)
+	}
+
+	return debug
+}
+
+// falseColor spreads the labels around the hue circle by the golden ratio so
+// neighboring labels get very different colors
+func falseColor(label int) color.RGBA {
+	_, hue := math.Modf(float64(label) * 0.618033988749895)
+	return hsvColor(hue*360, 0.7, 0.95)
+}
+
+// hsvColor converts hue in degrees, saturation and value (0-1) to RGB
+func hsvColor(hue, saturation, value float64) color.RGBA {
+	chroma := value * saturation
+	x := chroma * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+	var r, g, b float64
+	switch {
+	case hue < 60:
+		r, g = chroma, x
+	case hue < 120:
+		r, g = x, chroma
+	case hue < 180:
+		g, b = chroma, x
+	case hue < 240:
+		g, b = x, chroma
+	case hue < 300:
+		r, b = x, chroma
+	default:
+		r, b = chroma, x
+	}
+
+	m := value - chroma
+	return color.RGBA{
+		R: uint8(math.Round((r + m) * 0xff)),
+		G: uint8(math.Round((g + m) * 0xff)),
+		B: uint8(math.Round((b + m) * 0xff)),
+		A: 0xff,
+	}
+}
+
+// drawLine fills the rectangle, clipped to the image
+func drawLine(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	r = r.Intersect(img.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+// drawBox outlines the [top, bottom, left, right] pixels of a component
+func drawBox(img *image.RGBA, dimensions [4]int, c color.RGBA) {
+	top, bottom, left, right := dimensions[0], dimensions[1], dimensions[2], dimensions[3]
+	drawLine(img, image.Rect(left, top, right+1, top+1), c)
+	drawLine(img, image.Rect(left, bottom, right+1, bottom+1), c)
+	drawLine(img, image.Rect(left, top, left+1, bottom+1), c)
+	drawLine(img, image.Rect(right, top, right+1, bottom+1), c)
+}
@@ -0,0 +1,106 @@
+package transparency
+
+import "math"
+
+// chunkGrid is how the image is split up for chunked labeling
+// rowStarts/colStarts hold the first row/col of every chunk plus the image
+// height/width at the end, so chunk rows/cols don't need to be evenly sized
+type chunkGrid struct {
+	rows      int
+	cols      int
+	rowStarts []int
+	colStarts []int
+}
+
+// newChunkGrid spreads the rows and cols of the image evenly over the chunks
+func newChunkGrid(width, height, rows, cols int) chunkGrid {
+	rows = max(1, min(rows, height))
+	cols = max(1, min(cols, width))
+	return chunkGrid{
+		rows:      rows,
+		cols:      cols,
+		rowStarts: evenStarts(height, rows),
+		colStarts: evenStarts(width, cols),
+	}
+}
+
+// newTileGrid cuts the image into tileWidth x tileHeight tiles, the last tile
+// of each row and column takes whatever is left
+func newTileGrid(width, height, tileWidth, tileHeight int) chunkGrid {
+	rowStarts := tileStarts(height, tileHeight)
+	colStarts := tileStarts(width, tileWidth)
+	return chunkGrid{
+		rows:      len(rowStarts) - 1,
+		cols:      len(colStarts) - 1,
+		rowStarts: rowStarts,
+		colStarts: colStarts,
+	}
+}
+
+func evenStarts(size, parts int) []int {
+	starts := make([]int, parts+1)
+	for i := range starts {
+		starts[i] = i * size / parts
+	}
+	return starts
+}
+
+func tileStarts(size, tile int) []int {
+	if tile <= 0 || tile > size {
+		tile = size
+	}
+	var starts []int
+	for start := 0; start < size; start += tile {
+		starts = append(starts, start)
+	}
+	return append(starts, size)
+}
+
+// factorChunks splits chunks into the rows x cols grid whose chunks come
+// closest to the shape of the image, eg 8 chunks over a wide panorama is 2x4
+func factorChunks(chunks, width, height int) (int, int) {
+	bestRows, bestCols := 1, chunks
+	bestScore := math.Inf(1)
+	for rows := 1; rows <= chunks; rows++ {
+		if chunks%rows != 0 {
+			continue
+		}
+		cols := chunks / rows
+
+		// compare the chunk aspect ratio to a square on a log scale
+		chunkWidth := float64(width) / float64(cols)
+		chunkHeight := float64(height) / float64(rows)
+		score := math.Abs(math.Log(chunkWidth / chunkHeight))
+		if score < bestScore {
+			bestRows, bestCols, bestScore = rows, cols, score
+		}
+	}
+	return bestRows, bestCols
+}
+
+// chunkGrid picks the grid from the options, tile sizes win over an explicit
+// rows x cols which wins over Chunks, false when chunking is off
+func (opts Options) chunkGrid(width, height int) (chunkGrid, bool) {
+	switch {
+	case opts.TileWidth > 0 || opts.TileHeight > 0:
+		return newTileGrid(width, height, opts.TileWidth, opts.TileHeight), true
+	case opts.ChunkRows > 0 || opts.ChunkCols > 0:
+		return newChunkGrid(width, height, max(1, opts.ChunkRows), max(1, opts.ChunkCols)), true
+	case opts.Chunks > 0:
+		rows, cols := factorChunks(opts.Chunks, width, height)
+		return newChunkGrid(width, height, rows, cols), true
+	}
+	return chunkGrid{}, false
+}
+
+// chunks is the number of chunks in the grid
+func (g chunkGrid) chunks() int {
+	return g.rows * g.cols
+}
+
+// bounds returns the [startRow, startCol, endRow, endCol) of the chunk
+// chunks are numbered row by row
+func (g chunkGrid) bounds(chunk int) (int, int, int, int) {
+	row, col := chunk/g.cols, chunk%g.cols
+	return g.rowStarts[row], g.colStarts[col], g.rowStarts[row+1], g.colStarts[col+1]
+}
@@ -68,10 +68,9 @@ func square(num uint32) float64 {
 // colorDiff compares two RGB colors and returns the result
 // the Euclidean distance algorithm is based on this article
 // https://en.wikipedia.org/wiki/Color_difference
-func colorDiff(c1 color.Color, background [3]uint32) float64 {
-	r1, g1, b1, _ := c1.RGBA()
-	return math.Sqrt(square(background[0]-r1) +
-		square(background[1]-g1) + square(background[2]-b1))
+func colorDiff(c1 [3]uint32, background [3]uint32) float64 {
+	return math.Sqrt(square(background[0]-c1[0]) +
+		square(background[1]-c1[1]) + square(background[2]-c1[2]))
 }
 
 func ColorCompare(c1, c2 color.Color) bool {
@@ -82,7 +81,92 @@ func ColorCompare(c1, c2 color.Color) bool {
 
 const MaxInt = int(^uint(0) >> 1)
 
-type componentPixel struct {
-	pixel     color.Color
-	component int
+// Connectivity is which neighbors of a pixel belong to its component
+type Connectivity int
+
+const (
+	// FourConnected only joins pixels sharing an edge
+	FourConnected Connectivity = 4
+	// EightConnected also joins pixels touching at a corner
+	EightConnected Connectivity = 8
+)
+
+var (
+	fourNeighbors  = [][2]int{{0, -1}, {-1, 0}, {1, 0}, {0, 1}}
+	eightNeighbors = [][2]int{
+		{-1, -1}, {0, -1}, {1, -1},
+		{-1, 0}, {1, 0},
+		{-1, 1}, {0, 1}, {1, 1},
+	}
+)
+
+// offsets are the (col, row) steps to every neighbor
+func (c Connectivity) offsets() [][2]int {
+	if c == FourConnected {
+		return fourNeighbors
+	}
+	return eightNeighbors
+}
+
+// seamOffsets are the steps along a chunk seam to the pixels across it
+func (c Connectivity) seamOffsets() []int {
+	if c == FourConnected {
+		return []int{0}
+	}
+	return []int{-1, 0, 1}
+}
+
+// componentTotals are the running sums behind the Component statistics
+// they add up as chunk components merge, so nothing is rescanned
+type componentTotals struct {
+	sumX      int
+	sumY      int
+	sumColor  [3]uint64
+	perimeter int
+}
+
+// addPixel counts the pixel at (col, row) towards the centroid and mean color
+func (t *componentTotals) addPixel(col, row int, pixel [3]uint32) {
+	t.sumX += col
+	t.sumY += row
+	for i, channel := range pixel {
+		t.sumColor[i] += uint64(channel)
+	}
+}
+
+func (t *componentTotals) add(other componentTotals) {
+	t.sumX += other.sumX
+	t.sumY += other.sumY
+	for i := range t.sumColor {
+		t.sumColor[i] += other.sumColor[i]
+	}
+	t.perimeter += other.perimeter
+}
+
+// exposedSides counts the sides of every labeled pixel facing the background
+// or the edge of the matrix, reading the final labels so nothing is classified
+// again - add gets the count of each pixel that has any
+// any foreground 4 neighbor belongs to the same component, whatever the connectivity
+func exposedSides(matrix *pixelMatrix, add func(label, sides int)) {
+	width, height := matrix.width, matrix.height
+	for row := 0; row < height; row++ {
+		for col := 0; col < width; col++ {
+			label := matrix.label(row*width + col)
+			if label <= 0 {
+				continue
+			}
+
+			sides := 0
+			for _, offset := range fourNeighbors {
+				neighborCol, neighborRow := col+offset[0], row+offset[1]
+				if neighborCol < 0 || neighborRow < 0 || neighborCol >= width || neighborRow >= height ||
+					matrix.label(neighborRow*width+neighborCol) <= 0 {
+					sides++
+				}
+			}
+			if sides > 0 {
+				add(label, sides)
+			}
+		}
+	}
 }
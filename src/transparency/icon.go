@@ -1,64 +1,61 @@
 package transparency
 
 import (
+	"context"
 	"image"
-	"image/color"
-	"math"
+	"sync"
 	"sync/atomic"
 )
 
+// cancelCheckInterval is how many pixels a dfs visits between context checks
+const cancelCheckInterval = 1 << 12
+
 type chunkArea struct {
 	dimensions [4]int
 	pixels     int
+	totals     componentTotals
 }
 
 // findBackgroundColor scans the image for the most popular colors
-// using a hashmap it tracks the highest and returns that as the background
+// similar shades are clustered in a bucketed histogram, the centroid of the
+// biggest cluster is returned as the background
+// with BorderBackground only the pixels within borderWidth of the edge vote
 // alongside a 1d representation of the pixels for further computation
-func findBackgroundColor(img image.Image, width int, height int) ([3]uint32, []componentPixel) {
-	matrix := make([]componentPixel, width*height)
-	colorCount := make(map[color.Color]int)
-
-	var popularColor color.Color
-	maxPixelCount := 0
-
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			pixel := img.At(x, y)
-			pixelCount := 1
-			matrix[y*width+x].pixel = pixel
-
-			if count, ok := colorCount[pixel]; ok {
-				pixelCount += count
-			}
-			if pixelCount > maxPixelCount {
-				popularColor = pixel
-				maxPixelCount = pixelCount
-			}
-			colorCount[pixel] = pixelCount
-		}
+// paletteSize > 1 returns that many of the most popular clusters instead
+func findBackgroundColor(ctx context.Context, img image.Image, width int, height int,
+	strategy BackgroundStrategy, borderWidth int, paletteSize int) ([]Background, *pixelMatrix, error) {
+	matrix, err := readPixels(ctx, img)
+	if err != nil {
+		return nil, nil, err
 	}
+	histogram := newColorHistogram()
+	histogram.addMatrix(matrix, 0, 0, width, height, strategy, borderWidth)
 
-	red, green, blue, _ := popularColor.RGBA()
-	return [3]uint32{red, green, blue}, matrix
+	return histogram.palette(paletteSize), matrix, nil
 }
 
 // dfs iteratively adds neighbors to the component list to find the entire
 // connected icon - can't use recursive, causes stackoverflow with num pixels
-func dfs(col int, row int, width int, matrix []componentPixel,
-	background [3]uint32, component int, top, bottom, left, right int) (int, [4]int) {
+// it stops early once ctx is cancelled, leaving the component half labeled
+func dfs(ctx context.Context, col int, row int, width int, matrix *pixelMatrix,
+	background *classifier, component int, top, bottom, left, right int,
+	connectivity Connectivity) (int, [4]int, componentTotals) {
 	stack := [][2]int{{col, row}}
 	var col_row [2]int
 
 	count := 0
 	stackPointer := 0
-	neighbors := [3]int{-1, 0, 1}
-	neighborLength := len(neighbors)
+	neighbors := connectivity.offsets()
 
 	firstPixel := true
 	var pixelSpace [4]int
+	var totals componentTotals
+
+	for steps := 1; stackPointer > -1; steps++ {
+		if steps%cancelCheckInterval == 0 && ctx.Err() != nil {
+			break
+		}
 
-	for stackPointer > -1 {
 		col_row = stack[stackPointer]
 		stackPointer--
 		col = col_row[0]
@@ -69,14 +66,14 @@ func dfs(col int, row int, width int, matrix []componentPixel,
 		}
 
 		inx := row*width + col
-		if matrix[inx].component != 0 {
+		if matrix.label(inx) != 0 {
 			// we've visited this pixel
 			continue
 		}
 
-		if colorDiff(matrix[inx].pixel, background) < 15000 {
+		if background.isBackground(matrix.rgb(inx), col, row) {
 			// this is the background, don't want this component
-			matrix[inx].component = -1
+			matrix.setLabel(inx, -1)
 			continue
 		}
 
@@ -89,114 +86,130 @@ func dfs(col int, row int, width int, matrix []componentPixel,
 		// update dimensions of this icon [top, bottom, left, right]
 		if row < pixelSpace[0] {
 			pixelSpace[0] = row
-		} else if row > pixelSpace[1] {
+		}
+		if row > pixelSpace[1] {
 			pixelSpace[1] = row
 		}
 		if col < pixelSpace[2] {
 			pixelSpace[2] = col
-		} else if col > pixelSpace[3] {
+		}
+		if col > pixelSpace[3] {
 			pixelSpace[3] = col
 		}
 
-		matrix[inx].component = component
+		matrix.setLabel(inx, component)
+		totals.addPixel(col, row, matrix.rgb(inx))
 
-		for i := 0; i < neighborLength; i++ {
-			neighborColumn := col + neighbors[i]
-			for j := 0; j < neighborLength; j++ {
-				if i == 1 && j == 1 {
-					// don't redo our own (col, row) again
-					continue
-				}
-
-				stackPointer++
-				rc := [2]int{neighborColumn, row + neighbors[j]}
-				// try to add to original stack w/o append
-				if stackPointer < len(stack) {
-					stack[stackPointer] = rc
-				} else {
-					stack = append(stack, rc)
-				}
+		for _, offset := range neighbors {
+			stackPointer++
+			rc := [2]int{col + offset[0], row + offset[1]}
+			// try to add to original stack w/o append
+			if stackPointer < len(stack) {
+				stack[stackPointer] = rc
+			} else {
+				stack = append(stack, rc)
 			}
 		}
 
 		count += 1
 	}
 
-	return count, pixelSpace
+	return count, pixelSpace, totals
 }
 
-func buildTransparentImage(matrix []componentPixel, iconDimensions [4]int,
-	iconComponents map[int]bool, backgroundWidth int) *image.RGBA {
+// buildTransparentImage crops the icon out of the matrix, every pixel outside
+// the mask is transparent - a chroma key softens and despills the rest
+func buildTransparentImage(ctx context.Context, matrix *pixelMatrix, crop image.Rectangle,
+	mask *iconMask, backgroundWidth int, key *ChromaKey) (*image.RGBA, error) {
 
-	topPixel := iconDimensions[0]
-	bottomPixel := iconDimensions[1]
-	leftPixel := iconDimensions[2]
-	rightPixel := iconDimensions[3]
+	topPixel := crop.Min.Y
+	leftPixel := crop.Min.X
 
-	transparentColor := image.Transparent
-	iconWidth := rightPixel - leftPixel
-	iconHeight := bottomPixel - topPixel
+	iconWidth := crop.Dx()
+	iconHeight := crop.Dy()
+	// a new image is fully transparent, only the icon's pixels are written
 	background := image.NewRGBA(image.Rect(0, 0, iconWidth, iconHeight))
 
 	for j := 0; j < iconHeight; j++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		for i := 0; i < iconWidth; i++ {
+			if !mask.at(i+leftPixel, j+topPixel) {
+				continue
+			}
+
 			// accessing 2d matrix as 1d array https://stackoverflow.com/a/2151141
-			pixel := matrix[(j+topPixel)*backgroundWidth+(i+leftPixel)]
-			if _, ok := iconComponents[pixel.component]; ok {
-				// if this pixel is in any of the "icon" components, set the pixel
-				background.Set(i, j, pixel.pixel)
+			inx := (j+topPixel)*backgroundWidth + (i + leftPixel)
+			if key != nil {
+				background.Set(i, j, key.apply(matrix.rgb(inx)))
 			} else {
-				background.Set(i, j, transparentColor)
+				background.SetRGBA(i, j, matrix.color(inx))
 			}
 		}
 	}
 
-	return background
+	return background, nil
 }
 
-func findIconInChunkThreaded(componentInx *uint64,
-	startRow int, startCol int, endRow int, endCol int, width int,
-	matrix []componentPixel, background [3]uint32, channel chan map[int]chunkArea) {
-
-	componentDimensionMap := make(map[int]chunkArea)
-	reuseComponent := false
-	var currComponent int
-
-	for j := startRow; j < endRow; j++ {
-		for i := startCol; i < endCol; i++ {
-			if !reuseComponent {
-				// get a unique inx amongst all chunks
-				// only if we actually had a unique component last time
-				currComponent = int(atomic.AddUint64(componentInx, 1))
+// parallelFor runs fn over 0 to tasks-1 with a pool of workers goroutines
+// pulling tasks (chunks, seams) off a queue, returning once every task is done
+func parallelFor(tasks, workers int, fn func(task int)) {
+	// every task is queued up front so the workers never wait on the producer
+	queue := make(chan int, tasks)
+	for task := 0; task < tasks; task++ {
+		queue <- task
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < min(workers, tasks); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range queue {
+				fn(task)
 			}
+		}()
+	}
+	wg.Wait()
+}
 
-			componentPixelCount, dimensions := dfs(i, j, width, matrix,
-				background, currComponent, startRow, endRow, startCol, endCol)
-			if componentPixelCount > 0 {
-				// potential icon
-				componentDimensionMap[currComponent] = chunkArea{
-					dimensions: dimensions,
-					pixels:     componentPixelCount,
-				}
-				reuseComponent = false
-			} else {
-				reuseComponent = true
+// relabelChunk shifts every label of the chunk by offset, moving its
+// locally numbered components into their slot of the image wide labels
+func relabelChunk(grid chunkGrid, chunk, offset, width int, matrix *pixelMatrix,
+	componentDimensions map[int]chunkArea) map[int]chunkArea {
+	startRow, startCol, endRow, endCol := grid.bounds(chunk)
+	for row := startRow; row < endRow; row++ {
+		for col := startCol; col < endCol; col++ {
+			inx := row*width + col
+			if label := matrix.label(inx); label > 0 {
+				matrix.setLabel(inx, label+offset)
 			}
 		}
 	}
 
-	channel <- componentDimensionMap
+	shifted := make(map[int]chunkArea, len(componentDimensions))
+	for label, area := range componentDimensions {
+		shifted[label+offset] = area
+	}
+	return shifted
 }
 
-func findIconInChunk(componentInx *uint64,
+// findIconInChunk labels the chunk by running dfs from every unvisited pixel
+func findIconInChunk(ctx context.Context, componentInx *uint64,
 	startRow int, startCol int, endRow int, endCol int, width int,
-	matrix []componentPixel, background [3]uint32) map[int]chunkArea {
+	matrix *pixelMatrix, background *classifier, connectivity Connectivity) map[int]chunkArea {
 
 	componentDimensionMap := make(map[int]chunkArea)
 	reuseComponent := false
 	var currComponent int
 
 	for j := startRow; j < endRow; j++ {
+		if ctx.Err() != nil {
+			// the caller throws the labels away
+			break
+		}
 		for i := startCol; i < endCol; i++ {
 			if !reuseComponent {
 				// get a unique inx amongst all chunks
@@ -204,13 +217,14 @@ func findIconInChunk(componentInx *uint64,
 				currComponent = int(atomic.AddUint64(componentInx, 1))
 			}
 
-			componentPixelCount, dimensions := dfs(i, j, width, matrix,
-				background, currComponent, startRow, endRow, startCol, endCol)
+			componentPixelCount, dimensions, totals := dfs(ctx, i, j, width, matrix,
+				background, currComponent, startRow, endRow, startCol, endCol, connectivity)
 			if componentPixelCount > 0 {
 				// potential icon
 				componentDimensionMap[currComponent] = chunkArea{
 					dimensions: dimensions,
 					pixels:     componentPixelCount,
+					totals:     totals,
 				}
 				reuseComponent = false
 			} else {
@@ -222,298 +236,339 @@ func findIconInChunk(componentInx *uint64,
 	return componentDimensionMap
 }
 
-func mergeOnEitherSideByRow(matrix []componentPixel, unionFindArray *UnionFind, row, width int) {
-	for col := 0; col < width; col++ {
-		lowerPixelComponent := matrix[row*width+col].component
-		upperPixelComponent := matrix[(row-1)*width+col].component
-		if lowerPixelComponent > 0 {
+// unioner joins two labels, the plain UnionFind or the lock free concurrentUnionFind
+type unioner interface {
+	Union(p int, q int)
+}
+
+// mergeOnEitherSideByRow unions the components touching across the seam
+// between row-1 and row for the columns from startCol up to endCol
+// diagonals only count when 8 connected
+func mergeOnEitherSideByRow(
+	matrix *pixelMatrix,
+	unionFindArray unioner,
+	row, startCol, endCol, width int,
+	connectivity Connectivity,
+) {
+	for col := startCol; col < endCol; col++ {
+		lowerPixelComponent := matrix.label(row*width + col)
+		if lowerPixelComponent <= 0 {
+			continue
+		}
+
+		for _, offset := range connectivity.seamOffsets() {
+			upperCol := col + offset
+			if upperCol < 0 || upperCol >= width {
+				continue
+			}
+
+			upperPixelComponent := matrix.label((row-1)*width + upperCol)
 			if upperPixelComponent > 0 {
 				// these components should merge
 				unionFindArray.Union(upperPixelComponent, lowerPixelComponent)
-			} else if col != width-1 {
-				// check upper diagonal
-				upperDiagonalPixelComponent := matrix[(row-1)*width+(col+1)].component
-				if upperDiagonalPixelComponent > 0 {
-					unionFindArray.Union(upperDiagonalPixelComponent, lowerPixelComponent)
-				}
 			}
 		}
 	}
 }
 
+// mergeOnEitherSideByCol unions the components touching across the seam
+// between col-1 and col for the rows from startRow up to endRow
+// diagonals only count when 8 connected
 func mergeOnEitherSideByCol(
-	matrix []componentPixel,
-	unionFindArray *UnionFind,
-	col, height, width int,
+	matrix *pixelMatrix,
+	unionFindArray unioner,
+	col, startRow, endRow, height, width int,
+	connectivity Connectivity,
 ) {
-	for row := 0; row < height; row++ {
-		rightPixelComponent := matrix[row*width+col].component
-		leftPixelComponent := matrix[row*width+(col-1)].component
-		if rightPixelComponent > 0 {
+	for row := startRow; row < endRow; row++ {
+		rightPixelComponent := matrix.label(row*width + col)
+		if rightPixelComponent <= 0 {
+			continue
+		}
+
+		for _, offset := range connectivity.seamOffsets() {
+			leftRow := row + offset
+			if leftRow < 0 || leftRow >= height {
+				continue
+			}
+
+			leftPixelComponent := matrix.label(leftRow*width + (col - 1))
 			if leftPixelComponent > 0 {
 				// these components should merge
 				unionFindArray.Union(rightPixelComponent, leftPixelComponent)
-			} else if row != height-1 {
-				// check upper diagonal
-				leftDiagonalPixelComponent := matrix[(row+1)*width+(col-1)].component
-				if leftDiagonalPixelComponent > 0 {
-					unionFindArray.Union(leftDiagonalPixelComponent, rightPixelComponent)
-				}
 			}
 		}
 	}
 }
 
+// handleChunkMerge unions the components of neighboring chunks that touch
+// across the chunk seams, the union find groups every merged component
+// with more than one worker the seams are merged in parallel
 func handleChunkMerge(
-	componentNum, chunks, chunkRows, chunkRowSize, chunkColSize, width, height int,
+	componentNum, width, height int,
+	grid chunkGrid,
+	workers int,
 	chunkComponentDimensions []map[int]chunkArea,
-	matrix []componentPixel,
-) ([4]int, map[int]bool) {
+	matrix *pixelMatrix,
+	connectivity Connectivity,
+) *UnionFind {
 	// merge chunks together
 	// run union find on the merge chunks
 	// run through the intersections of the chunks only (ignore edges of picture as there's no intersections)
-	unionFindParents := NewUnionFind(componentNum, chunks, chunkComponentDimensions)
+	// labels are handed out starting at 1, so componentNum itself is a valid label
+	unionFindParents := NewUnionFind(componentNum+1, grid.chunks(), chunkComponentDimensions)
+	if workers > 1 {
+		mergeSeamsConcurrently(unionFindParents, grid, workers, width, height, matrix, connectivity)
+		return unionFindParents
+	}
 
 	// merge chunks by the intersections
 	// ignore the outsides of the image because they won't have any merging
-	for rowIntersection := 1; rowIntersection < chunkRows; rowIntersection++ {
+	for rowIntersection := 1; rowIntersection < grid.rows; rowIntersection++ {
 		mergeOnEitherSideByRow(
 			matrix,
 			unionFindParents,
-			rowIntersection*chunkRowSize,
+			grid.rowStarts[rowIntersection],
+			0,
 			width,
+			width,
+			connectivity,
 		)
 	}
 
-	for colIntersection := 1; colIntersection < chunkRows; colIntersection++ {
+	for colIntersection := 1; colIntersection < grid.cols; colIntersection++ {
 		mergeOnEitherSideByCol(
 			matrix,
 			unionFindParents,
-			colIntersection*chunkColSize,
+			grid.colStarts[colIntersection],
+			0,
+			height,
 			height,
 			width,
+			connectivity,
 		)
 	}
 
-	maxComponentInx := 0
-	maxComponentPixelCount := 0
-
-	// when two icon components merge, the entire icon dimensions need to merge
-	var maxComponentDimensions [4]int
+	return unionFindParents
+}
 
-	// start at 1, component 0 is reserved and unused
-	for i := 1; i < len(unionFindParents.root); i++ {
-		unionFindParent := unionFindParents.area[unionFindParents.Root(i)]
-		if unionFindParent.totalPixels > maxComponentPixelCount {
-			maxComponentInx = i
-			maxComponentPixelCount = unionFindParent.totalPixels
-			maxComponentDimensions = unionFindParent.totalDimensions
+// mergeSeamsConcurrently splits every seam at the chunk corners and merges the
+// pieces in parallel on a concurrentUnionFind, which is then flattened into
+// unionFindParents - each set ends up rooted at its lowest label
+func mergeSeamsConcurrently(
+	unionFindParents *UnionFind,
+	grid chunkGrid,
+	workers, width, height int,
+	matrix *pixelMatrix,
+	connectivity Connectivity,
+) {
+	links := newConcurrentUnionFind(len(unionFindParents.root))
+
+	// a row seam has a piece per chunk column, a col seam one per chunk row
+	rowPieces := (grid.rows - 1) * grid.cols
+	colPieces := (grid.cols - 1) * grid.rows
+	parallelFor(rowPieces+colPieces, workers, func(piece int) {
+		if piece < rowPieces {
+			seam, col := piece/grid.cols+1, piece%grid.cols
+			mergeOnEitherSideByRow(matrix, links, grid.rowStarts[seam],
+				grid.colStarts[col], grid.colStarts[col+1], width, connectivity)
+			return
 		}
-	}
 
-	// group chunk components together after merge for final component check
-	// eg chunk1 had component65 that merged with chunk2's component800
-	// the result icon's component hashset is {65, 800}
-	maxComponentSet := make(map[int]bool)
-	maxComponentSet[maxComponentInx] = true
+		piece -= rowPieces
+		seam, row := piece/grid.rows+1, piece%grid.rows
+		mergeOnEitherSideByCol(matrix, links, grid.colStarts[seam],
+			grid.rowStarts[row], grid.rowStarts[row+1], height, width, connectivity)
+	})
 
-	for i := 1; i < len(unionFindParents.root); i++ {
-		if unionFindParents.Connected(i, maxComponentInx) {
-			// this component belongs to the maximum icon's set
-			maxComponentSet[i] = true
-		}
-	}
-
-	return maxComponentDimensions, maxComponentSet
+	links.flatten(unionFindParents)
 }
 
-// findIcon takes an image and searches for the connected components
-// it then returns the component (and dimensions) with maximum pixel count
-func findIconChunk(width int, height int, matrix []componentPixel,
-	background [3]uint32, chunks int) ([4]int, map[int]bool) {
+// findIconChunk labels the connected components chunk by chunk
+// then merges the chunks back together into a single union find
+func findIconChunk(ctx context.Context, width int, height int, matrix *pixelMatrix,
+	background *classifier, grid chunkGrid, connectivity Connectivity,
+	labelChunk chunkLabeler) (*UnionFind, error) {
 	/*
-	   * split the image into equal size chunks
+	   * split the image into the chunks of the grid
 	   * in each chunk, find the connected components
 	   * find where the chunks intersect, then merge
-	   * return the maximum merged icon's dimensions and details
+	   * return the merged union find, the caller picks the icon out of it
 	       * save space by only grabbing the required height/width instead of entire image
 	*/
 
-	// want same number of chunks in the height and width
-	chunkRows := int(math.Sqrt(float64(chunks)))
-	chunkRowSize := height / chunkRows
-	chunkColSize := width / chunkRows
-
 	// will serve as atomic thread-safe counter to avoid component inx collisions
 	var componentNum uint64 = 0
 
-	chunkComponentDimensions := make([]map[int]chunkArea, chunks)
-
-	chunk := 0
+	chunkComponentDimensions := make([]map[int]chunkArea, grid.chunks())
 
-	for row := 0; row < chunkRows; row++ {
-		endRow := (row + 1) * chunkRowSize
-		if row == chunkRows-1 && endRow != height {
-			// chunks might not have been evenly distributed
-			endRow = height
+	for chunk := range chunkComponentDimensions {
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
-		for col := 0; col < chunkRows; col++ {
-			// each chunk updates the matrix in place
-			endCol := (col + 1) * chunkColSize
-			if col == chunkRows-1 && endCol != width {
-				// chunk columns weren't even
-				endCol = width
-			}
 
-			chunkComponentDimensions[chunk] = findIconInChunk(
-				&componentNum,
-				row*chunkRowSize,
-				col*chunkColSize,
-				endRow,
-				endCol,
-				width,
-				matrix,
-				background,
-			)
-			chunk++
-		}
+		// each chunk updates the matrix in place
+		startRow, startCol, endRow, endCol := grid.bounds(chunk)
+		chunkComponentDimensions[chunk] = labelChunk(
+			ctx,
+			&componentNum,
+			startRow,
+			startCol,
+			endRow,
+			endCol,
+			width,
+			matrix,
+			background,
+			connectivity,
+		)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
 	return handleChunkMerge(
 		int(componentNum),
-		chunks,
-		chunkRows,
-		chunkRowSize,
-		chunkColSize,
 		width,
 		height,
+		grid,
+		1,
 		chunkComponentDimensions,
 		matrix,
-	)
+		connectivity,
+	), nil
 }
 
-// it then returns the component (and dimensions) with maximum pixel count
-func findIconChunkThread(width int, height int, matrix []componentPixel,
-	background [3]uint32, chunks int) ([4]int, map[int]bool) {
+// findIconChunkThread is findIconChunk with the chunks labeled and the seams
+// merged in parallel by a pool of workers goroutines pulling off a queue
+// the labels come out the same on every run (and the same as findIconChunk)
+// each chunk numbers its components from 1 on its own, then a prefix sum of
+// the counts gives every chunk its range of labels and a second pass shifts them
+func findIconChunkThread(ctx context.Context, width int, height int, matrix *pixelMatrix,
+	background *classifier, grid chunkGrid, workers int, connectivity Connectivity,
+	labelChunk chunkLabeler) (*UnionFind, error) {
 	/*
-	   * split the image into equal size chunks
+	   * split the image into the chunks of the grid
 	   * in each chunk, find the connected components
 	   * find where the chunks intersect, then merge
-	   * return the maximum merged icon's dimensions and details
+	   * return the merged union find, the caller picks the icon out of it
 	       * save space by only grabbing the required height/width instead of entire image
 	*/
 
-	// want same number of chunks in the height and width
-	chunkRows := int(math.Sqrt(float64(chunks)))
-	chunkRowSize := height / chunkRows
-	chunkColSize := width / chunkRows
-
-	// will serve as atomic thread-safe counter to avoid component inx collisions
-	var componentNum uint64 = 0
-
-	chunkComponentDimensions := make([]map[int]chunkArea, chunks)
-
-	c1 := make(chan map[int]chunkArea)
-
-	for row := 0; row < chunkRows; row++ {
-		endRow := (row + 1) * chunkRowSize
-		if row == chunkRows-1 && endRow != height {
-			// chunks might not have been evenly distributed
-			endRow = height
-		}
-		for col := 0; col < chunkRows; col++ {
-			// each chunk updates the matrix in place
-			endCol := (col + 1) * chunkColSize
-			if col == chunkRows-1 && endCol != width {
-				// chunk columns weren't even
-				endCol = width
-			}
-
-			go findIconInChunkThreaded(&componentNum, row*chunkRowSize, col*chunkColSize,
-				endRow, endCol, width, matrix, background, c1)
-		}
+	// results are indexed by chunk, so the order chunks finish in doesn't matter
+	chunkComponentDimensions := make([]map[int]chunkArea, grid.chunks())
+	chunkLabels := make([]int, grid.chunks())
+	parallelFor(grid.chunks(), workers, func(chunk int) {
+		// once ctx is cancelled the labeler returns straight away
+		var componentNum uint64 = 0
+		startRow, startCol, endRow, endCol := grid.bounds(chunk)
+		chunkComponentDimensions[chunk] = labelChunk(ctx, &componentNum, startRow, startCol,
+			endRow, endCol, width, matrix, background, connectivity)
+		chunkLabels[chunk] = int(componentNum)
+	})
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	for chunk := 0; chunk < chunks; chunk++ {
-		data := <-c1
-		chunkComponentDimensions[chunk] = data
+	offsets := make([]int, grid.chunks())
+	componentNum := 0
+	for chunk, labels := range chunkLabels {
+		offsets[chunk] = componentNum
+		componentNum += labels
 	}
 
+	parallelFor(grid.chunks(), workers, func(chunk int) {
+		chunkComponentDimensions[chunk] = relabelChunk(grid, chunk, offsets[chunk], width,
+			matrix, chunkComponentDimensions[chunk])
+	})
+
 	return handleChunkMerge(
-		int(componentNum),
-		chunks,
-		chunkRows,
-		chunkRowSize,
-		chunkColSize,
+		componentNum,
 		width,
 		height,
+		grid,
+		workers,
 		chunkComponentDimensions,
 		matrix,
-	)
+		connectivity,
+	), nil
 }
 
 // findIcon takes an image and searches for the connected components
-// it then returns the component (and dimensions) with maximum pixel count
-func findIcon(width int, height int, matrix []componentPixel,
-	background [3]uint32) ([4]int, map[int]bool) {
+// every component is its own set in the returned union find
+func findIcon(ctx context.Context, width int, height int, matrix *pixelMatrix,
+	background *classifier, connectivity Connectivity, labelChunk chunkLabeler) (*UnionFind, error) {
 	/*
 		 * find connected components
 		 	* connected components are surrounded by "background" color
 			* which separates them from other components
-		 * find connected component with highest numPixels
-		 * trim the image into only the icon's dimensions to save space
+		 * the caller picks the icon out of the components
 	*/
 
-	components := 1
-	maxComponent := 1
-	maxComponentPixelCount := 0
-	var componentDimensions [][4]int
-
-	for j := 0; j < height; j++ {
-		for i := 0; i < width; i++ {
-			componentPixelCount, dimensions := dfs(i, j, width, matrix,
-				background, components, 0, height, 0, width)
-			if componentPixelCount > 0 {
-				if componentPixelCount > maxComponentPixelCount {
-					maxComponentPixelCount = componentPixelCount
-					maxComponent = components
-				}
-
-				componentDimensions = append(componentDimensions, dimensions)
-				components += 1
-			}
-		}
+	var componentNum uint64 = 0
+	componentDimensions := labelChunk(ctx, &componentNum, 0, 0, height, width, width,
+		matrix, background, connectivity)
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	return componentDimensions[maxComponent-1], map[int]bool{maxComponent: true}
+	return NewUnionFind(int(componentNum)+1, 1, []map[int]chunkArea{componentDimensions}), nil
 }
 
 // RunIcon is the main entrypoint into the algorithm
 // when given an image, it finds the background, components
 // and returns the transparent png result
+// chunks can be AutoChunks to let the image size decide
 func RunIcon(img image.Image, chunks int, threaded bool) *image.RGBA {
-	backgroundWidth := img.Bounds().Dx()
-	backgroundHeight := img.Bounds().Dy()
-
-	backgroundColor, pixelMatrix := findBackgroundColor(img, backgroundWidth, backgroundHeight)
-
-	var iconDimensions [4]int
-	var iconComponentMap map[int]bool
-
-	if chunks > 0 {
-		// run by chunking
-		if threaded {
-			// run chunks in parallel
-			iconDimensions, iconComponentMap = findIconChunkThread(backgroundWidth,
-				backgroundHeight, pixelMatrix, backgroundColor, chunks)
-		} else {
-			iconDimensions, iconComponentMap = findIconChunk(backgroundWidth,
-				backgroundHeight, pixelMatrix, backgroundColor, chunks)
-		}
-	} else {
-		iconDimensions, iconComponentMap = findIcon(backgroundWidth,
-			backgroundHeight, pixelMatrix, backgroundColor)
+	return RunIconWithOptions(img, Options{Chunks: chunks, Threaded: threaded}).Icon
+}
+
+// RunIconWithOptions is RunIcon with every knob exposed through Options
+// the result also reports how the background was detected
+func RunIconWithOptions(img image.Image, opts Options) Result {
+	res, err := RunIconContext(context.Background(), img, opts)
+	check(err)
+	return res
+}
+
+// RunIconContext is RunIconWithOptions that gives up once ctx is cancelled or
+// its deadline passes, returning ctx.Err() - every goroutine it started has
+// exited by the time it returns
+func RunIconContext(ctx context.Context, img image.Image, opts Options) (Result, error) {
+	opts = opts.autoChunks(img.Bounds().Dx(), img.Bounds().Dy())
+	labeled, err := labelImage(ctx, img, opts)
+	if err != nil {
+		return Result{}, err
+	}
+
+	iconDimensions, iconComponentMap, components, choice := labeled.selectIcon(opts)
+	icon, _, err := labeled.render(ctx, iconDimensions, iconComponentMap, opts, false)
+	if err != nil {
+		return Result{}, err
 	}
 
-	return buildTransparentImage(pixelMatrix, iconDimensions, iconComponentMap, backgroundWidth)
+	var debug *image.RGBA
+	if opts.Debug {
+		debug = labeled.debugImage(iconDimensions, iconComponentMap, choice >= 0)
+	}
+
+	return Result{
+		Icon:       icon,
+		Background: labeled.palette[0],
+		Palette:    labeled.palette,
+		Strategy:   opts.Background,
+		Model:      opts.Model,
+
+		Threshold:     labeled.classifier.threshold,
+		AutoThreshold: labeled.classifier.autoThreshold,
+
+		Chunks:   opts.Chunks,
+		Threaded: opts.Threaded,
+
+		Components: components,
+		Selected:   choice,
+
+		Debug: debug,
+	}, nil
 }
@@ -0,0 +1,139 @@
+package transparency
+
+// iconMask marks the kept pixels inside the icon's bounding box
+type iconMask struct {
+	// top and left of the box in image coordinates
+	top    int
+	left   int
+	width  int
+	height int
+	kept   []bool
+}
+
+// newIconMask keeps every pixel of the bounding box whose label is in the icon set
+func newIconMask(matrix *pixelMatrix, iconDimensions [4]int,
+	iconComponents map[int]bool, backgroundWidth int) *iconMask {
+	mask := &iconMask{
+		top:    iconDimensions[0],
+		left:   iconDimensions[2],
+		width:  max(iconDimensions[3]-iconDimensions[2]+1, 0),
+		height: max(iconDimensions[1]-iconDimensions[0]+1, 0),
+	}
+	mask.kept = make([]bool, mask.width*mask.height)
+
+	for j := 0; j < mask.height; j++ {
+		for i := 0; i < mask.width; i++ {
+			inx := (j+mask.top)*backgroundWidth + (i + mask.left)
+			mask.kept[j*mask.width+i] = iconComponents[matrix.label(inx)]
+		}
+	}
+
+	return mask
+}
+
+// at reports if the pixel at image coordinates (col, row) is kept
+func (m *iconMask) at(col, row int) bool {
+	col -= m.left
+	row -= m.top
+	if col < 0 || row < 0 || col >= m.width || row >= m.height {
+		return false
+	}
+	return m.kept[row*m.width+col]
+}
+
+// backgroundNeighbors is the connectivity of the removed pixels, the
+// complement of the icon's so a diagonal gap in a 4 connected outline
+// doesn't leak while an 8 connected outline still seals the hole
+func backgroundNeighbors(connectivity Connectivity) [][2]int {
+	if connectivity == FourConnected {
+		return EightConnected.offsets()
+	}
+	return FourConnected.offsets()
+}
+
+// fillHoles keeps the removed regions that can't reach the image border and
+// are at most maxArea pixels, a negative maxArea fills every hole
+// everything outside the bounding box is removed and joined around it
+// so flooding from the edge of the box is the same as flooding from the border
+func (m *iconMask) fillHoles(connectivity Connectivity, maxArea int) {
+	neighbors := backgroundNeighbors(connectivity)
+	regions := m.outside(neighbors)
+
+	// label every hole left over, tracking its area
+	holeAreas := []int{0}
+	for j := 0; j < m.height; j++ {
+		for i := 0; i < m.width; i++ {
+			if area := m.flood(i, j, len(holeAreas), regions, neighbors); area > 0 {
+				holeAreas = append(holeAreas, area)
+			}
+		}
+	}
+
+	for inx, region := range regions {
+		if region > 0 && (maxArea < 0 || holeAreas[region] <= maxArea) {
+			// enclosed by the icon and small enough, keep it opaque
+			m.kept[inx] = true
+		}
+	}
+}
+
+// outside floods the removed pixels from the edge of the box
+// 0 unvisited (a hole), -1 reaches the border - fillHoles labels the holes after
+func (m *iconMask) outside(neighbors [][2]int) []int {
+	regions := make([]int, len(m.kept))
+	for j := 0; j < m.height; j++ {
+		for i := 0; i < m.width; i++ {
+			edge := j == 0 || i == 0 || j == m.height-1 || i == m.width-1
+			if edge {
+				m.flood(i, j, -1, regions, neighbors)
+			}
+		}
+	}
+	return regions
+}
+
+// enclosed reports if the removed pixel at image coordinates (col, row) sits
+// in a hole of the mask, regions comes from outside
+func (m *iconMask) enclosed(col, row int, regions []int) bool {
+	col -= m.left
+	row -= m.top
+	if col < 0 || row < 0 || col >= m.width || row >= m.height {
+		return false
+	}
+	inx := row*m.width + col
+	return !m.kept[inx] && regions[inx] == 0
+}
+
+// flood gives every removed pixel connected to (col, row) the region label
+// returning how many pixels it labeled - 0 if the start was kept or visited
+func (m *iconMask) flood(col, row, region int, regions []int, neighbors [][2]int) int {
+	start := row*m.width + col
+	if m.kept[start] || regions[start] != 0 {
+		return 0
+	}
+
+	regions[start] = region
+	stack := [][2]int{{col, row}}
+	area := 0
+	for len(stack) > 0 {
+		col_row := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		area++
+
+		for _, offset := range neighbors {
+			col, row := col_row[0]+offset[0], col_row[1]+offset[1]
+			if col < 0 || row < 0 || col >= m.width || row >= m.height {
+				continue
+			}
+
+			inx := row*m.width + col
+			if m.kept[inx] || regions[inx] != 0 {
+				continue
+			}
+			regions[inx] = region
+			stack = append(stack, [2]int{col, row})
+		}
+	}
+
+	return area
+}
@@ -0,0 +1,207 @@
+package transparency
+
+import "math"
+
+// ColorMetric measures how far a pixel is from the expected background color
+// both are 16 bit per channel RGB triples, the same scale as color.Color.RGBA
+type ColorMetric interface {
+	Distance(pixel, background [3]uint32) float64
+	// DefaultThreshold is the background cutoff in the metric's own units
+	DefaultThreshold() float64
+}
+
+// EuclideanRGB is the straight line distance in 16 bit RGB space
+type EuclideanRGB struct{}
+
+func (EuclideanRGB) Distance(pixel, background [3]uint32) float64 {
+	return colorDiff(pixel, background)
+}
+
+func (EuclideanRGB) DefaultThreshold() float64 {
+	return backgroundThreshold
+}
+
+// DeltaE76 is the euclidean distance in CIELAB, ~2.3 is a just noticeable difference
+type DeltaE76 struct{}
+
+func (d DeltaE76) Distance(pixel, background [3]uint32) float64 {
+	return d.DistanceLab(toLab(pixel), toLab(background))
+}
+
+// DistanceLab is Distance for colors already in CIELAB
+func (DeltaE76) DistanceLab(pixel, background Lab) float64 {
+	return math.Sqrt((pixel.L-background.L)*(pixel.L-background.L) +
+		(pixel.A-background.A)*(pixel.A-background.A) +
+		(pixel.B-background.B)*(pixel.B-background.B))
+}
+
+func (DeltaE76) DefaultThreshold() float64 {
+	return 20
+}
+
+// DeltaE94 weighs the chroma and hue differences by the chroma of the background
+// using the graphic arts constants
+type DeltaE94 struct{}
+
+func (d DeltaE94) Distance(pixel, background [3]uint32) float64 {
+	return d.DistanceLab(toLab(pixel), toLab(background))
+}
+
+// DistanceLab is Distance for colors already in CIELAB, background is the reference
+func (DeltaE94) DistanceLab(pixel, background Lab) float64 {
+	reference, sample := background, pixel
+
+	c1 := math.Hypot(reference.A, reference.B)
+	c2 := math.Hypot(sample.A, sample.B)
+	dl := reference.L - sample.L
+	dc := c1 - c2
+	da := reference.A - sample.A
+	db := reference.B - sample.B
+	// hue difference falls out of what's left after lightness and chroma
+	dh := math.Sqrt(math.Max(da*da+db*db-dc*dc, 0))
+
+	sc := 1 + 0.045*c1
+	sh := 1 + 0.015*c1
+	return math.Sqrt(dl*dl + (dc/sc)*(dc/sc) + (dh/sh)*(dh/sh))
+}
+
+func (DeltaE94) DefaultThreshold() float64 {
+	return 15
+}
+
+// DeltaE2000 is the CIEDE2000 difference, the closest to human perception
+// formula from http://www2.ece.rochester.edu/~gsharma/ciede2000/
+type DeltaE2000 struct{}
+
+func (d DeltaE2000) Distance(pixel, background [3]uint32) float64 {
+	return d.DistanceLab(toLab(pixel), toLab(background))
+}
+
+// DistanceLab is Distance for colors already in CIELAB
+func (DeltaE2000) DistanceLab(pixel, background Lab) float64 {
+	return deltaE2000(pixel, background)
+}
+
+func (DeltaE2000) DefaultThreshold() float64 {
+	return 15
+}
+
+func deltaE2000(lab1, lab2 Lab) float64 {
+	c1 := math.Hypot(lab1.A, lab1.B)
+	c2 := math.Hypot(lab2.A, lab2.B)
+	cMean7 := math.Pow((c1+c2)/2, 7)
+	g := 0.5 * (1 - math.Sqrt(cMean7/(cMean7+math.Pow(25, 7))))
+
+	a1 := (1 + g) * lab1.A
+	a2 := (1 + g) * lab2.A
+	c1Prime := math.Hypot(a1, lab1.B)
+	c2Prime := math.Hypot(a2, lab2.B)
+	h1Prime := hueAngle(lab1.B, a1)
+	h2Prime := hueAngle(lab2.B, a2)
+
+	dlPrime := lab2.L - lab1.L
+	dcPrime := c2Prime - c1Prime
+
+	var dhPrime float64
+	if c1Prime*c2Prime != 0 {
+		dhPrime = h2Prime - h1Prime
+		if dhPrime > 180 {
+			dhPrime -= 360
+		} else if dhPrime < -180 {
+			dhPrime += 360
+		}
+	}
+	dHPrime := 2 * math.Sqrt(c1Prime*c2Prime) * math.Sin(radians(dhPrime/2))
+
+	lMean := (lab1.L + lab2.L) / 2
+	cMeanPrime := (c1Prime + c2Prime) / 2
+	hMeanPrime := h1Prime + h2Prime
+	if c1Prime*c2Prime != 0 {
+		if math.Abs(h1Prime-h2Prime) <= 180 {
+			hMeanPrime /= 2
+		} else if hMeanPrime < 360 {
+			hMeanPrime = (hMeanPrime + 360) / 2
+		} else {
+			hMeanPrime = (hMeanPrime - 360) / 2
+		}
+	}
+
+	t := 1 - 0.17*math.Cos(radians(hMeanPrime-30)) +
+		0.24*math.Cos(radians(2*hMeanPrime)) +
+		0.32*math.Cos(radians(3*hMeanPrime+6)) -
+		0.20*math.Cos(radians(4*hMeanPrime-63))
+	dTheta := 30 * math.Exp(-math.Pow((hMeanPrime-275)/25, 2))
+	cMeanPrime7 := math.Pow(cMeanPrime, 7)
+	rc := 2 * math.Sqrt(cMeanPrime7/(cMeanPrime7+math.Pow(25, 7)))
+	lOffset := (lMean - 50) * (lMean - 50)
+	sl := 1 + 0.015*lOffset/math.Sqrt(20+lOffset)
+	sc := 1 + 0.045*cMeanPrime
+	sh := 1 + 0.015*cMeanPrime*t
+	rt := -math.Sin(radians(2*dTheta)) * rc
+
+	return math.Sqrt((dlPrime/sl)*(dlPrime/sl) +
+		(dcPrime/sc)*(dcPrime/sc) +
+		(dHPrime/sh)*(dHPrime/sh) +
+		rt*(dcPrime/sc)*(dHPrime/sh))
+}
+
+// hueAngle is atan2 in degrees, wrapped into [0, 360)
+func hueAngle(b, a float64) float64 {
+	if a == 0 && b == 0 {
+		return 0
+	}
+	angle := math.Atan2(b, a) * 180 / math.Pi
+	if angle < 0 {
+		angle += 360
+	}
+	return angle
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// Lab is a CIELAB color under the D65 white point
+type Lab struct {
+	L, A, B float64
+}
+
+// D65 reference white
+const (
+	whiteX = 0.95047
+	whiteY = 1.0
+	whiteZ = 1.08883
+)
+
+// toLab converts 16 bit sRGB to CIELAB, going through linear RGB and XYZ
+func toLab(c [3]uint32) Lab {
+	r := linearize(float64(c[0]) / 0xffff)
+	g := linearize(float64(c[1]) / 0xffff)
+	b := linearize(float64(c[2]) / 0xffff)
+
+	x := labCurve((0.4124564*r + 0.3575761*g + 0.1804375*b) / whiteX)
+	y := labCurve((0.2126729*r + 0.7151522*g + 0.0721750*b) / whiteY)
+	z := labCurve((0.0193339*r + 0.1191920*g + 0.9503041*b) / whiteZ)
+
+	return Lab{
+		L: 116*y - 16,
+		A: 500 * (x - y),
+		B: 200 * (y - z),
+	}
+}
+
+// linearize undoes the sRGB gamma
+func linearize(channel float64) float64 {
+	if channel <= 0.04045 {
+		return channel / 12.92
+	}
+	return math.Pow((channel+0.055)/1.055, 2.4)
+}
+
+// labCurve is the cube root with a linear segment near black
+func labCurve(t float64) float64 {
+	if t > 216.0/24389.0 {
+		return math.Cbrt(t)
+	}
+	return (24389.0/27.0*t + 16) / 116
+}
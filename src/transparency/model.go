@@ -0,0 +1,307 @@
+package transparency
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// backgroundThreshold is the EuclideanRGB cutoff, anything closer to the
+// expected background color than this is considered background
+const backgroundThreshold = 15000
+
+// defaultGradientGrid is the cells per side when Options.GradientGrid is unset
+const defaultGradientGrid = 8
+
+// BackgroundModel picks how the expected background color varies over the image
+type BackgroundModel int
+
+const (
+	// UniformModel expects the same background color at every pixel
+	UniformModel BackgroundModel = iota
+	// GradientModel fits a coarse grid over the background samples and
+	// interpolates between the cells, following lighting gradients and vignettes
+	GradientModel
+)
+
+func (m BackgroundModel) String() string {
+	switch m {
+	case UniformModel:
+		return "uniform"
+	case GradientModel:
+		return "gradient"
+	}
+	return fmt.Sprintf("BackgroundModel(%d)", int(m))
+}
+
+// backgroundModel predicts the background color at a pixel
+type backgroundModel interface {
+	expected(col, row int) [3]uint32
+}
+
+// uniformBackground is a single background color for the whole image
+type uniformBackground [3]uint32
+
+func (u uniformBackground) expected(col, row int) [3]uint32 {
+	return u
+}
+
+// gradientBackground holds the mean background color of each grid cell
+// colors between cell centers are bilinearly interpolated
+type gradientBackground struct {
+	cells      [][3]float64
+	cols       int
+	rows       int
+	cellWidth  float64
+	cellHeight float64
+}
+
+// fitGradientBackground averages the pixels close to the global background in
+// each cell of a grid x grid layout - the icon is too far off to be sampled
+// cells without any samples are grown from their neighbors
+func fitGradientBackground(ctx context.Context, matrix *pixelMatrix, width, height int,
+	background [3]uint32, grid int, metric ColorMetric, threshold float64) (*gradientBackground, error) {
+	cols := min(grid, width)
+	rows := min(grid, height)
+	model := &gradientBackground{
+		cells:      make([][3]float64, cols*rows),
+		cols:       cols,
+		rows:       rows,
+		cellWidth:  float64(width) / float64(cols),
+		cellHeight: float64(height) / float64(rows),
+	}
+
+	// a gradient drifts away from the global mean, so be generous when sampling
+	sampleThreshold := 2 * threshold
+	filled := make([]bool, len(model.cells))
+	remaining := len(model.cells)
+	for cell := range model.cells {
+		mean, ok := model.sampleCell(ctx, matrix, width, height, cell, background, metric, sampleThreshold)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if ok {
+			model.cells[cell] = mean
+			filled[cell] = true
+			remaining--
+		}
+	}
+
+	if remaining == len(model.cells) {
+		// nothing looked like the background, fall back to a flat model
+		for cell := range model.cells {
+			for i := 0; i < 3; i++ {
+				model.cells[cell][i] = float64(background[i])
+			}
+		}
+		return model, nil
+	}
+
+	// grow one ring of cells at a time, each new cell resamples its own
+	// pixels against what its neighbors predict so the fit follows the gradient
+	for remaining > 0 {
+		ring := make(map[int][3]float64)
+		for cell := range model.cells {
+			if filled[cell] {
+				continue
+			}
+
+			estimate, ok := model.neighborMean(cell, filled)
+			if !ok {
+				continue
+			}
+
+			reference := [3]uint32{
+				uint32(math.Round(estimate[0])),
+				uint32(math.Round(estimate[1])),
+				uint32(math.Round(estimate[2])),
+			}
+			mean, ok := model.sampleCell(ctx, matrix, width, height, cell, reference, metric, sampleThreshold)
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if ok {
+				estimate = mean
+			}
+			ring[cell] = estimate
+		}
+
+		// only mark after the pass so the fill spreads evenly in every direction
+		for cell, estimate := range ring {
+			model.cells[cell] = estimate
+			filled[cell] = true
+		}
+		remaining -= len(ring)
+	}
+
+	return model, nil
+}
+
+// sampleCell averages the pixels of the cell within sampleThreshold of reference
+// it gives up (returning false) once ctx is cancelled
+func (m *gradientBackground) sampleCell(ctx context.Context, matrix *pixelMatrix, width, height, cell int,
+	reference [3]uint32, metric ColorMetric, sampleThreshold float64) ([3]float64, bool) {
+	cellRow, cellCol := cell/m.cols, cell%m.cols
+	startRow, endRow := cellRow*height/m.rows, (cellRow+1)*height/m.rows
+	startCol, endCol := cellCol*width/m.cols, (cellCol+1)*width/m.cols
+
+	var sum [3]float64
+	count := 0
+	for row := startRow; row < endRow; row++ {
+		if ctx.Err() != nil {
+			return sum, false
+		}
+		for col := startCol; col < endCol; col++ {
+			pixel := matrix.rgb(row*width + col)
+			if metric.Distance(pixel, reference) >= sampleThreshold {
+				continue
+			}
+
+			for i := 0; i < 3; i++ {
+				sum[i] += float64(pixel[i])
+			}
+			count++
+		}
+	}
+
+	if count == 0 {
+		return sum, false
+	}
+	for i := 0; i < 3; i++ {
+		sum[i] /= float64(count)
+	}
+	return sum, true
+}
+
+// neighborMean averages the already filled cells around cell
+func (m *gradientBackground) neighborMean(cell int, filled []bool) ([3]float64, bool) {
+	var sum [3]float64
+	neighbors := 0
+	cellRow, cellCol := cell/m.cols, cell%m.cols
+	for dr := -1; dr <= 1; dr++ {
+		for dc := -1; dc <= 1; dc++ {
+			r, c := cellRow+dr, cellCol+dc
+			if r < 0 || c < 0 || r >= m.rows || c >= m.cols || !filled[r*m.cols+c] {
+				continue
+			}
+			for i := 0; i < 3; i++ {
+				sum[i] += m.cells[r*m.cols+c][i]
+			}
+			neighbors++
+		}
+	}
+
+	if neighbors == 0 {
+		return sum, false
+	}
+	for i := 0; i < 3; i++ {
+		sum[i] /= float64(neighbors)
+	}
+	return sum, true
+}
+
+// axisPosition maps a pixel coordinate onto the two surrounding cell centers
+// and the interpolation weight of the second one
+func axisPosition(coord int, cellSize float64, cells int) (int, int, float64) {
+	position := (float64(coord)+0.5)/cellSize - 0.5
+	position = math.Max(0, math.Min(position, float64(cells-1)))
+	low := int(position)
+	high := min(low+1, cells-1)
+	return low, high, position - float64(low)
+}
+
+func (m *gradientBackground) expected(col, row int) [3]uint32 {
+	c0, c1, tx := axisPosition(col, m.cellWidth, m.cols)
+	r0, r1, ty := axisPosition(row, m.cellHeight, m.rows)
+
+	topLeft := m.cells[r0*m.cols+c0]
+	topRight := m.cells[r0*m.cols+c1]
+	bottomLeft := m.cells[r1*m.cols+c0]
+	bottomRight := m.cells[r1*m.cols+c1]
+
+	var result [3]uint32
+	for i := 0; i < 3; i++ {
+		top := topLeft[i] + (topRight[i]-topLeft[i])*tx
+		bottom := bottomLeft[i] + (bottomRight[i]-bottomLeft[i])*tx
+		result[i] = uint32(math.Round(top + (bottom-top)*ty))
+	}
+	return result
+}
+
+// classifier decides which pixels belong to the background
+// a pixel close enough to any of the models is background
+type classifier struct {
+	models    []backgroundModel
+	metric    ColorMetric
+	threshold float64
+	// autoThreshold is the Otsu threshold, 0 unless Options.AutoThreshold is set
+	autoThreshold float64
+	// key replaces the color distance with hue keying when set
+	key *ChromaKey
+}
+
+// newClassifier builds one model per palette color, the first (most popular)
+// color is fitted with a gradient when Options.Model asks for it
+// fitting the gradient and the auto threshold stop once ctx is cancelled
+func newClassifier(ctx context.Context, opts Options, palette []Background, matrix *pixelMatrix,
+	width, height int) (*classifier, error) {
+	c := &classifier{
+		models: make([]backgroundModel, len(palette)),
+		metric: opts.Metric,
+		key:    opts.ChromaKey,
+	}
+	if c.metric == nil {
+		c.metric = EuclideanRGB{}
+	}
+	c.threshold = opts.Threshold
+	if c.threshold <= 0 {
+		c.threshold = c.metric.DefaultThreshold()
+	}
+	for i, background := range palette {
+		c.models[i] = uniformBackground(background.Color)
+	}
+
+	if opts.Model == GradientModel {
+		grid := opts.GradientGrid
+		if grid <= 0 {
+			grid = defaultGradientGrid
+		}
+		model, err := fitGradientBackground(ctx, matrix, width, height,
+			palette[0].Color, grid, c.metric, c.threshold)
+		if err != nil {
+			return nil, err
+		}
+		c.models[0] = model
+	}
+
+	if opts.AutoThreshold && c.key == nil {
+		autoThreshold, err := otsuThreshold(ctx, c, matrix, width, height)
+		if err != nil {
+			return nil, err
+		}
+		c.autoThreshold = autoThreshold
+		if opts.Threshold <= 0 && c.autoThreshold > 0 {
+			// a manual threshold always wins over the computed one
+			c.threshold = c.autoThreshold
+		}
+	}
+
+	return c, nil
+}
+
+// distance is how far the pixel is from the closest background expected at (col, row)
+func (c *classifier) distance(pixel [3]uint32, col, row int) float64 {
+	closest := math.Inf(1)
+	for _, model := range c.models {
+		closest = math.Min(closest, c.metric.Distance(pixel, model.expected(col, row)))
+	}
+	return closest
+}
+
+// isBackground compares the pixel against the backgrounds expected at (col, row)
+func (c *classifier) isBackground(pixel [3]uint32, col, row int) bool {
+	if c.key != nil {
+		return c.key.matches(pixel)
+	}
+	return c.distance(pixel, col, row) < c.threshold
+}
@@ -0,0 +1,222 @@
+package transparency
+
+import (
+	"fmt"
+	"image"
+)
+
+// StructuringElement is the neighborhood of a morphological operation, as
+// offsets from the pixel being decided
+type StructuringElement []image.Point
+
+// SquareElement covers a (2*radius+1) square around the pixel
+func SquareElement(radius int) StructuringElement {
+	return elementWhere(radius, func(x, y int) bool {
+		return true
+	})
+}
+
+// DiskElement covers every offset within radius of the pixel
+func DiskElement(radius int) StructuringElement {
+	return elementWhere(radius, func(x, y int) bool {
+		return x*x+y*y <= radius*radius
+	})
+}
+
+// CrossElement covers the row and column through the pixel out to radius
+func CrossElement(radius int) StructuringElement {
+	return elementWhere(radius, func(x, y int) bool {
+		return x == 0 || y == 0
+	})
+}
+
+func elementWhere(radius int, inside func(x, y int) bool) StructuringElement {
+	var element StructuringElement
+	for y := -radius; y <= radius; y++ {
+		for x := -radius; x <= radius; x++ {
+			if inside(x, y) {
+				element = append(element, image.Pt(x, y))
+			}
+		}
+	}
+	return element
+}
+
+// radius is the furthest the element reaches along either axis
+func (e StructuringElement) radius() int {
+	reach := 0
+	for _, p := range e {
+		reach = max(reach, max(max(p.X, -p.X), max(p.Y, -p.Y)))
+	}
+	return reach
+}
+
+// MorphologyKind is which mask operation to run
+type MorphologyKind int
+
+const (
+	// Erode shrinks the icon, shaving halo fringes off its outline
+	Erode MorphologyKind = iota
+	// Dilate grows the icon
+	Dilate
+	// Open erodes then dilates, removing thin spurs without shrinking the icon
+	Open
+	// Close dilates then erodes, sealing hairline gaps without growing the icon
+	Close
+)
+
+func (k MorphologyKind) String() string {
+	switch k {
+	case Erode:
+		return "erode"
+	case Dilate:
+		return "dilate"
+	case Open:
+		return "open"
+	case Close:
+		return "close"
+	}
+	return fmt.Sprintf("MorphologyKind(%d)", int(k))
+}
+
+// MorphologyOp is one post-processing step over the icon mask
+type MorphologyOp struct {
+	Kind    MorphologyKind
+	Element StructuringElement
+}
+
+// growth is how far the op can push the mask past its current box
+func (op MorphologyOp) growth() int {
+	if op.Kind == Erode || op.Kind == Open {
+		return 0
+	}
+	return op.Element.radius()
+}
+
+// applyMorphology runs the ops in order on a copy of the mask grown enough to
+// hold any dilation (clipped to the image), then trims it to the kept pixels
+func (m *iconMask) applyMorphology(ops []MorphologyOp, imageWidth, imageHeight int) *iconMask {
+	margin := 0
+	for _, op := range ops {
+		margin += op.growth()
+	}
+
+	result := m.grown(margin, imageWidth, imageHeight)
+	for _, op := range ops {
+		switch op.Kind {
+		case Erode:
+			result.erode(op.Element)
+		case Dilate:
+			result.dilate(op.Element)
+		case Open:
+			result.erode(op.Element)
+			result.dilate(op.Element)
+		case Close:
+			result.dilate(op.Element)
+			result.erode(op.Element)
+		}
+	}
+
+	return result.trimmed()
+}
+
+// grown copies the mask into a box margin pixels bigger on every side
+func (m *iconMask) grown(margin, imageWidth, imageHeight int) *iconMask {
+	top := max(m.top-margin, 0)
+	left := max(m.left-margin, 0)
+	bottom := min(m.top+m.height+margin, imageHeight)
+	right := min(m.left+m.width+margin, imageWidth)
+
+	result := &iconMask{
+		top:    top,
+		left:   left,
+		width:  max(right-left, 0),
+		height: max(bottom-top, 0),
+	}
+	result.kept = make([]bool, result.width*result.height)
+	for j := 0; j < result.height; j++ {
+		for i := 0; i < result.width; i++ {
+			result.kept[j*result.width+i] = m.at(i+left, j+top)
+		}
+	}
+	return result
+}
+
+// erode keeps a pixel only if the element placed on it is fully kept
+// anything outside the box counts as removed
+func (m *iconMask) erode(element StructuringElement) {
+	kept := make([]bool, len(m.kept))
+	for j := 0; j < m.height; j++ {
+		for i := 0; i < m.width; i++ {
+			if !m.kept[j*m.width+i] {
+				continue
+			}
+
+			all := true
+			for _, p := range element {
+				if !m.at(m.left+i+p.X, m.top+j+p.Y) {
+					all = false
+					break
+				}
+			}
+			kept[j*m.width+i] = all
+		}
+	}
+	m.kept = kept
+}
+
+// dilate keeps a pixel if the reflected element placed on it touches a kept pixel
+func (m *iconMask) dilate(element StructuringElement) {
+	kept := make([]bool, len(m.kept))
+	for j := 0; j < m.height; j++ {
+		for i := 0; i < m.width; i++ {
+			for _, p := range element {
+				if m.at(m.left+i-p.X, m.top+j-p.Y) {
+					kept[j*m.width+i] = true
+					break
+				}
+			}
+		}
+	}
+	m.kept = kept
+}
+
+// trimmed shrinks the box down to the kept pixels
+func (m *iconMask) trimmed() *iconMask {
+	dimensions := m.dimensions()
+	if dimensions[1] < dimensions[0] {
+		return &iconMask{top: m.top, left: m.left}
+	}
+
+	result := &iconMask{
+		top:    dimensions[0],
+		left:   dimensions[2],
+		width:  dimensions[3] - dimensions[2] + 1,
+		height: dimensions[1] - dimensions[0] + 1,
+	}
+	result.kept = make([]bool, result.width*result.height)
+	for j := 0; j < result.height; j++ {
+		for i := 0; i < result.width; i++ {
+			result.kept[j*result.width+i] = m.at(i+result.left, j+result.top)
+		}
+	}
+	return result
+}
+
+// dimensions is the [top, bottom, left, right] box of the kept pixels in image
+// coordinates, bottom < top when nothing is kept
+func (m *iconMask) dimensions() [4]int {
+	dimensions := [4]int{MaxInt, -1, MaxInt, -1}
+	for j := 0; j < m.height; j++ {
+		for i := 0; i < m.width; i++ {
+			if !m.kept[j*m.width+i] {
+				continue
+			}
+			dimensions = mergeDimensions(dimensions, [4]int{m.top + j, m.top + j, m.left + i, m.left + i})
+		}
+	}
+	if dimensions[1] < 0 {
+		return [4]int{m.top, m.top - 1, m.left, m.left - 1}
+	}
+	return dimensions
+}
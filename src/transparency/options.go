@@ -0,0 +1,117 @@
+package transparency
+
+import (
+	"image"
+	"image/color"
+)
+
+// Options tunes RunIconWithOptions, the zero value behaves like RunIcon(img, 0, false)
+type Options struct {
+	// Chunks splits the image into a grid of chunks for labeling (0 disables chunking)
+	// counts that aren't square are factored into the rows x cols closest to
+	// the shape of the image, eg 8 chunks over a wide panorama is 2x4
+	// AutoChunks picks the chunks and Threaded from the image size instead
+	Chunks int
+	// Calibration tunes AutoChunks to this machine, DefaultCalibration when nil
+	Calibration *Calibration
+	// ChunkRows and ChunkCols set the shape of the grid explicitly, overriding Chunks
+	ChunkRows int
+	ChunkCols int
+	// TileWidth and TileHeight cut the image into tiles of this many pixels
+	// instead, the last tile of each row and column takes what is left
+	// an unset side spans the whole image, tiles override ChunkRows/ChunkCols
+	TileWidth  int
+	TileHeight int
+	// TempDir holds the per-tile label files of RunIconTiled, os.TempDir when empty
+	TempDir string
+	// Threaded labels the chunks in parallel
+	Threaded bool
+	// Workers caps the goroutines labeling chunks when Threaded, GOMAXPROCS when unset
+	Workers int
+	// Labeling picks the connected component algorithm run in each chunk
+	Labeling LabelingAlgorithm
+
+	// Background picks the strategy used to estimate the background color
+	Background BackgroundStrategy
+	// BorderWidth is the ring width in pixels sampled by BorderBackground
+	BorderWidth int
+
+	// Model picks how the expected background color varies over the image
+	Model BackgroundModel
+	// GradientGrid is the cells per side fitted by GradientModel
+	GradientGrid int
+
+	// PaletteSize treats the N most popular color clusters as background
+	// for two-tone or striped backgrounds
+	PaletteSize int
+	// Palette lists the background colors up front, skipping detection
+	Palette []color.Color
+
+	// Metric measures the distance to the background, EuclideanRGB when nil
+	Metric ColorMetric
+	// Threshold is the background cutoff in Metric units, the metric's
+	// DefaultThreshold when unset
+	Threshold float64
+	// AutoThreshold computes a per-image threshold with Otsu's method over the
+	// distances to the background, used unless Threshold is set
+	AutoThreshold bool
+
+	// ChromaKey keys out a green/blue screen by hue instead of color distance
+	// kept pixels near the key get a soft alpha and optional despill
+	ChromaKey *ChromaKey
+
+	// Connectivity joins pixels by edges only (FourConnected) or corners as
+	// well (EightConnected, the default) in every labeling path
+	Connectivity Connectivity
+
+	// Selection picks the icon out of the components, LargestArea when nil
+	Selection SelectionPolicy
+	// MinComponentArea drops components under this many pixels (jpeg noise)
+	// before the icon is selected
+	MinComponentArea int
+	// AbsorbSpeckles adds the dropped components touching the icon - in one of
+	// its holes or at one of its corners - to the icon instead of making them
+	// transparent
+	AbsorbSpeckles bool
+
+	// BorderConnected only removes the background connected to the image
+	// border, holes enclosed by the icon (eyes, letter counters) stay opaque
+	BorderConnected bool
+	// MaxHoleArea fills the holes of the icon up to this many pixels, larger
+	// holes (the inside of a ring logo) stay transparent, 0 disables it
+	MaxHoleArea int
+	// Morphology runs erode/dilate/open/close steps over the icon mask, in
+	// order, before holes are filled and the png is built
+	Morphology []MorphologyOp
+
+	// Debug draws the label map into Result.Debug
+	Debug bool
+}
+
+// Result is the transparent icon and the details used to produce it
+// Background is the first (most popular) entry of Palette
+type Result struct {
+	Icon       *image.RGBA
+	Background Background
+	Palette    []Background
+	Strategy   BackgroundStrategy
+	Model      BackgroundModel
+	// Threshold is the background cutoff that was applied
+	Threshold float64
+	// AutoThreshold is the Otsu threshold, 0 unless Options.AutoThreshold is set
+	AutoThreshold float64
+
+	// Chunks and Threaded are the labeling that ran, see AutoChunks
+	Chunks   int
+	Threaded bool
+
+	// Components lists every labeled component with its statistics
+	Components []Component
+	// Selected is the index of the icon in Components, -1 when nothing was picked
+	Selected int
+
+	// Debug is the label map when Options.Debug is set - every component in its
+	// own false color (dimmed unless it's part of the icon) over a dark background,
+	// the chunk grid in white, bounding boxes in yellow and the icon's box in red
+	Debug *image.RGBA
+}
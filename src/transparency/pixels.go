@@ -0,0 +1,109 @@
+package transparency
+
+import (
+	"context"
+	"image"
+	"image/color"
+)
+
+// pixelMatrix is the image packed as 8 bit RGB, 3 bytes a pixel, with a
+// separate int32 component label per pixel - 7 bytes a pixel instead of the
+// ~32 of a color.Color interface value next to an int
+// the RGB is premultiplied like color.Color.RGBA, alpha stays nil until a
+// pixel that isn't opaque turns up
+// labels are 0 while unvisited, -1 for the background, > 0 for a component
+type pixelMatrix struct {
+	width  int
+	height int
+	pix    []uint8
+	alpha  []uint8
+	labels []int32
+}
+
+func newPixelMatrix(width, height int) *pixelMatrix {
+	return &pixelMatrix{
+		width:  width,
+		height: height,
+		pix:    make([]uint8, 3*width*height),
+		labels: make([]int32, width*height),
+	}
+}
+
+// readPixels copies the image into a pixelMatrix
+// *image.YCbCr (decoded jpegs) and *image.RGBA are read straight from their
+// buffers, anything else goes through img.At
+func readPixels(ctx context.Context, img image.Image) (*pixelMatrix, error) {
+	bounds := img.Bounds()
+	matrix := newPixelMatrix(bounds.Dx(), bounds.Dy())
+
+	for row := 0; row < matrix.height; row++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		y := bounds.Min.Y + row
+		out := matrix.pix[3*row*matrix.width : 3*(row+1)*matrix.width]
+		switch src := img.(type) {
+		case *image.YCbCr:
+			for col := 0; col < matrix.width; col++ {
+				x := bounds.Min.X + col
+				yi, ci := src.YOffset(x, y), src.COffset(x, y)
+				out[3*col], out[3*col+1], out[3*col+2] = color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+			}
+		case *image.RGBA:
+			in := src.Pix[src.PixOffset(bounds.Min.X, y):]
+			for col := 0; col < matrix.width; col++ {
+				copy(out[3*col:3*col+3], in[4*col:4*col+3])
+				if a := in[4*col+3]; a != 0xff {
+					matrix.setAlpha(row*matrix.width+col, a)
+				}
+			}
+		default:
+			for col := 0; col < matrix.width; col++ {
+				r, g, b, a := img.At(bounds.Min.X+col, y).RGBA()
+				out[3*col], out[3*col+1], out[3*col+2] = uint8(r>>8), uint8(g>>8), uint8(b>>8)
+				if a != 0xffff {
+					matrix.setAlpha(row*matrix.width+col, uint8(a>>8))
+				}
+			}
+		}
+	}
+
+	return matrix, nil
+}
+
+// rgb is the pixel in 16 bit channels, the same scale as color.Color.RGBA
+func (m *pixelMatrix) rgb(inx int) [3]uint32 {
+	p := m.pix[3*inx : 3*inx+3]
+	return [3]uint32{uint32(p[0]) * 0x101, uint32(p[1]) * 0x101, uint32(p[2]) * 0x101}
+}
+
+// color is the (premultiplied) color of the pixel
+func (m *pixelMatrix) color(inx int) color.RGBA {
+	p := m.pix[3*inx : 3*inx+3]
+	a := uint8(0xff)
+	if m.alpha != nil {
+		a = m.alpha[inx]
+	}
+	return color.RGBA{R: p[0], G: p[1], B: p[2], A: a}
+}
+
+// setAlpha records a pixel that isn't opaque, the alpha of every pixel is
+// only stored once the first one turns up
+func (m *pixelMatrix) setAlpha(inx int, a uint8) {
+	if m.alpha == nil {
+		m.alpha = make([]uint8, m.width*m.height)
+		for i := range m.alpha {
+			m.alpha[i] = 0xff
+		}
+	}
+	m.alpha[inx] = a
+}
+
+func (m *pixelMatrix) label(inx int) int {
+	return int(m.labels[inx])
+}
+
+func (m *pixelMatrix) setLabel(inx, label int) {
+	m.labels[inx] = int32(label)
+}
@@ -0,0 +1,130 @@
+package transparency
+
+import (
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// pngSignature starts every png file
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+// maxIDATSize is how much compressed data is buffered before an IDAT chunk is written
+const maxIDATSize = 1 << 16
+
+// pngRowWriter streams an 8 bit RGBA (non premultiplied) png one row at a
+// time, image/png needs the whole image in memory before it can encode it
+// https://www.w3.org/TR/png/
+type pngRowWriter struct {
+	w      io.Writer
+	idat   *idatWriter
+	zw     *zlib.Writer
+	width  int
+	height int
+	rows   int
+}
+
+// newPNGRowWriter writes the signature and header, the rows follow through WriteRow
+func newPNGRowWriter(w io.Writer, width, height int) (*pngRowWriter, error) {
+	if width <= 0 || height <= 0 {
+		return nil, errors.New("png: image is empty")
+	}
+	if _, err := w.Write(pngSignature); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header[0:4], uint32(width))
+	binary.BigEndian.PutUint32(header[4:8], uint32(height))
+	header[8] = 8 // bit depth
+	header[9] = 6 // color type: truecolor with alpha
+	// compression, filter and interlace methods are all 0
+	if err := writePNGChunk(w, "IHDR", header); err != nil {
+		return nil, err
+	}
+
+	idat := &idatWriter{w: w}
+	return &pngRowWriter{
+		w:      w,
+		idat:   idat,
+		zw:     zlib.NewWriter(idat),
+		width:  width,
+		height: height,
+	}, nil
+}
+
+// WriteRow adds the next row, 4 bytes (RGBA) per pixel
+func (p *pngRowWriter) WriteRow(row []byte) error {
+	if len(row) != 4*p.width || p.rows == p.height {
+		return errors.New("png: row doesn't fit the image")
+	}
+	p.rows++
+
+	// every row starts with its filter type, 0 leaves the row as is
+	if _, err := p.zw.Write([]byte{0}); err != nil {
+		return err
+	}
+	_, err := p.zw.Write(row)
+	return err
+}
+
+// Close flushes the compressed rows and ends the file, every row must have been written
+func (p *pngRowWriter) Close() error {
+	if p.rows != p.height {
+		return errors.New("png: missing rows")
+	}
+	if err := p.zw.Close(); err != nil {
+		return err
+	}
+	if err := p.idat.flush(); err != nil {
+		return err
+	}
+	return writePNGChunk(p.w, "IEND", nil)
+}
+
+// idatWriter splits the zlib stream into IDAT chunks
+type idatWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (i *idatWriter) Write(data []byte) (int, error) {
+	i.buf = append(i.buf, data...)
+	if len(i.buf) >= maxIDATSize {
+		if err := i.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (i *idatWriter) flush() error {
+	if len(i.buf) == 0 {
+		return nil
+	}
+	err := writePNGChunk(i.w, "IDAT", i.buf)
+	i.buf = i.buf[:0]
+	return err
+}
+
+// writePNGChunk writes the length, type, data and crc of a chunk
+func writePNGChunk(w io.Writer, chunkType string, data []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], chunkType)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	var footer [4]byte
+	binary.BigEndian.PutUint32(footer[:], crc.Sum32())
+
+	for _, part := range [][]byte{header[:], data, footer[:]} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package transparency
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Component is one connected component after the chunks merged
+// the statistics are gathered while labeling, nothing is rescanned
+type Component struct {
+	// Label is the union find root shared by every label of the component
+	Label  int
+	Pixels int
+	// Bounds is the bounding box of the component, every one of its pixels
+	// lies inside (Max is exclusive, like any image.Rectangle)
+	Bounds image.Rectangle
+	// CentroidX and CentroidY are the mean pixel position
+	CentroidX float64
+	CentroidY float64
+	// Perimeter counts the pixel sides facing the background or image edge
+	Perimeter int
+	MeanColor color.RGBA64
+	// TouchesBorder is set when the component reaches an image edge
+	TouchesBorder bool
+
+	contains func(image.Point) bool
+}
+
+// Contains reports if the pixel at p belongs to the component
+func (c Component) Contains(p image.Point) bool {
+	return c.contains != nil && c.contains(p)
+}
+
+// SelectionPolicy picks the icon out of the components, returning its index
+// frame is the full image, returning -1 picks nothing (an empty icon)
+type SelectionPolicy func(components []Component, frame image.Rectangle) int
+
+// LargestArea picks the component with the most pixels, the default
+func LargestArea() SelectionPolicy {
+	return func(components []Component, frame image.Rectangle) int {
+		return maxBy(components, func(c Component) float64 {
+			return float64(c.Pixels)
+		})
+	}
+}
+
+// LargestBounds picks the component with the biggest bounding box, counting
+// every row and column it covers - a thin ring logo beats a solid blob with
+// more pixels, and a one pixel hairline still has an area
+func LargestBounds() SelectionPolicy {
+	return func(components []Component, frame image.Rectangle) int {
+		return maxBy(components, func(c Component) float64 {
+			return float64(c.Bounds.Dx() * c.Bounds.Dy())
+		})
+	}
+}
+
+// ClosestToCenter picks the component whose bounding box center is nearest
+// the center of the image, ignoring components under minPixels
+func ClosestToCenter(minPixels int) SelectionPolicy {
+	return func(components []Component, frame image.Rectangle) int {
+		centerX := float64(frame.Min.X+frame.Max.X) / 2
+		centerY := float64(frame.Min.Y+frame.Max.Y) / 2
+		return maxBy(components, func(c Component) float64 {
+			if c.Pixels < minPixels {
+				return math.Inf(-1)
+			}
+			x := float64(c.Bounds.Min.X+c.Bounds.Max.X) / 2
+			y := float64(c.Bounds.Min.Y+c.Bounds.Max.Y) / 2
+			return -math.Hypot(x-centerX, y-centerY)
+		})
+	}
+}
+
+// ContainingPoint picks the component covering the pixel at p
+// nothing is picked when p lands on the background
+func ContainingPoint(p image.Point) SelectionPolicy {
+	return func(components []Component, frame image.Rectangle) int {
+		for i, c := range components {
+			if c.Contains(p) {
+				return i
+			}
+		}
+		return -1
+	}
+}
+
+// maxBy returns the index of the first component with the highest score
+// a score of -Inf rules the component out, -1 when every one is ruled out
+func maxBy(components []Component, score func(Component) float64) int {
+	best := -1
+	bestScore := math.Inf(-1)
+	for i, c := range components {
+		if s := score(c); s > bestScore {
+			best = i
+			bestScore = s
+		}
+	}
+	return best
+}
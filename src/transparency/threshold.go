@@ -0,0 +1,66 @@
+package transparency
+
+import "context"
+
+// otsuBins is the resolution of the distance histogram
+const otsuBins = 256
+
+// otsuThreshold splits the distances to the background into two classes
+// (background and icon) using Otsu's method, picking the cutoff that maximizes
+// the variance between the classes https://en.wikipedia.org/wiki/Otsu%27s_method
+// returns 0 when every pixel is the same distance away
+func otsuThreshold(ctx context.Context, c *classifier, matrix *pixelMatrix, width, height int) (float64, error) {
+	distances := make([]float64, width*height)
+	maxDistance := 0.0
+	for row := 0; row < height; row++ {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		for col := 0; col < width; col++ {
+			inx := row*width + col
+			distances[inx] = c.distance(matrix.rgb(inx), col, row)
+			if distances[inx] > maxDistance {
+				maxDistance = distances[inx]
+			}
+		}
+	}
+
+	if maxDistance == 0 {
+		return 0, nil
+	}
+
+	var histogram [otsuBins]int
+	binWidth := maxDistance / otsuBins
+	for _, distance := range distances {
+		histogram[min(int(distance/binWidth), otsuBins-1)]++
+	}
+
+	total := float64(len(distances))
+	weightedTotal := 0.0
+	for bin, count := range histogram {
+		weightedTotal += float64(bin * count)
+	}
+
+	bestBin := 0
+	bestVariance := 0.0
+	backgroundCount, backgroundWeighted := 0.0, 0.0
+	for bin, count := range histogram {
+		backgroundCount += float64(count)
+		backgroundWeighted += float64(bin * count)
+		iconCount := total - backgroundCount
+		if backgroundCount == 0 || iconCount == 0 {
+			continue
+		}
+
+		backgroundMean := backgroundWeighted / backgroundCount
+		iconMean := (weightedTotal - backgroundWeighted) / iconCount
+		variance := backgroundCount * iconCount * (backgroundMean - iconMean) * (backgroundMean - iconMean)
+		if variance > bestVariance {
+			bestVariance = variance
+			bestBin = bin
+		}
+	}
+
+	// everything up to and including bestBin is background
+	return float64(bestBin+1) * binWidth, nil
+}
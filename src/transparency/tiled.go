@@ -0,0 +1,432 @@
+package transparency
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// defaultTileSize is the tile width and height RunIconTiled uses when
+// Options.TileWidth/TileHeight are unset
+const defaultTileSize = 1024
+
+// tileStore keeps the labels of every tile on disk, one file per tile
+// holding the tile's labels row by row followed by its left and right
+// columns, so both kinds of seams are a single read
+type tileStore struct {
+	dir   string
+	grid  chunkGrid
+	files []*os.File
+}
+
+func newTileStore(tempDir string, grid chunkGrid) (*tileStore, error) {
+	dir, err := os.MkdirTemp(tempDir, "imageconverter-tiles-")
+	if err != nil {
+		return nil, err
+	}
+	return &tileStore{
+		dir:   dir,
+		grid:  grid,
+		files: make([]*os.File, grid.chunks()),
+	}, nil
+}
+
+// tileSize is the width and height of the tile
+func (s *tileStore) tileSize(tile int) (int, int) {
+	startRow, startCol, endRow, endCol := s.grid.bounds(tile)
+	return endCol - startCol, endRow - startRow
+}
+
+// write saves the labels of the tile
+func (s *tileStore) write(tile int, matrix *pixelMatrix) error {
+	file, err := os.Create(filepath.Join(s.dir, fmt.Sprintf("tile-%d.labels", tile)))
+	if err != nil {
+		return err
+	}
+	s.files[tile] = file
+
+	left := make([]int32, matrix.height)
+	right := make([]int32, matrix.height)
+	for row := range left {
+		left[row] = matrix.labels[row*matrix.width]
+		right[row] = matrix.labels[row*matrix.width+matrix.width-1]
+	}
+
+	out := bufio.NewWriter(file)
+	for _, labels := range [][]int32{matrix.labels, left, right} {
+		if err := binary.Write(out, binary.LittleEndian, labels); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// read fills labels starting at the offset-th label of the tile's file
+func (s *tileStore) read(tile, offset int, labels []int32) error {
+	buf := make([]byte, 4*len(labels))
+	if _, err := s.files[tile].ReadAt(buf, 4*int64(offset)); err != nil {
+		return err
+	}
+	for i := range labels {
+		labels[i] = int32(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return nil
+}
+
+// readRow reads a row of the tile, row is relative to the tile
+func (s *tileStore) readRow(tile, row int, labels []int32) error {
+	width, _ := s.tileSize(tile)
+	return s.read(tile, row*width, labels[:width])
+}
+
+// readCol reads the left or right column of the tile
+func (s *tileStore) readCol(tile int, right bool, labels []int32) error {
+	width, height := s.tileSize(tile)
+	offset := width * height
+	if right {
+		offset += height
+	}
+	return s.read(tile, offset, labels[:height])
+}
+
+// labelAt reads back the label of the pixel at image coordinates (col, row)
+func (s *tileStore) labelAt(col, row int) int {
+	tileRow, tileCol := 0, 0
+	for s.grid.rowStarts[tileRow+1] <= row {
+		tileRow++
+	}
+	for s.grid.colStarts[tileCol+1] <= col {
+		tileCol++
+	}
+
+	tile := tileRow*s.grid.cols + tileCol
+	width, _ := s.tileSize(tile)
+	label := make([]int32, 1)
+	offset := (row-s.grid.rowStarts[tileRow])*width + col - s.grid.colStarts[tileCol]
+	if err := s.read(tile, offset, label); err != nil {
+		return 0
+	}
+	return int(label[0])
+}
+
+// Close deletes the label files
+func (s *tileStore) Close() error {
+	for _, file := range s.files {
+		if file != nil {
+			file.Close()
+		}
+	}
+	return os.RemoveAll(s.dir)
+}
+
+// readTile decodes the tile into a pixelMatrix
+func readTile(ctx context.Context, src TileReader, grid chunkGrid, tile int) (*pixelMatrix, error) {
+	startRow, startCol, endRow, endCol := grid.bounds(tile)
+	origin := src.Bounds().Min
+	img, err := src.ReadTile(image.Rect(startCol, startRow, endCol, endRow).Add(origin))
+	if err != nil {
+		return nil, err
+	}
+	return readPixels(ctx, img)
+}
+
+// mergeSeam unions the labels on either side of a seam, before and after are
+// the rows (or columns) of labels touching across it
+// both sides counted their shared edges as exposed, that's taken back off
+func mergeSeam(unionFindArray *UnionFind, before, after []int32, connectivity Connectivity) {
+	for i, afterLabel := range after {
+		if afterLabel <= 0 {
+			continue
+		}
+
+		for _, offset := range connectivity.seamOffsets() {
+			j := i + offset
+			if j < 0 || j >= len(before) || before[j] <= 0 {
+				continue
+			}
+
+			if offset == 0 {
+				unionFindArray.area[unionFindArray.Root(int(afterLabel))].totals.perimeter -= 2
+			}
+			unionFindArray.Union(int(before[j]), int(afterLabel))
+		}
+	}
+}
+
+// mergeTileSeams reads every seam back from disk and merges the labels across
+// rows are merged over the full image width so diagonals across tile corners join too
+func mergeTileSeams(store *tileStore, unionFindArray *UnionFind, width, height int,
+	connectivity Connectivity) error {
+	grid := store.grid
+	before := make([]int32, max(width, height))
+	after := make([]int32, max(width, height))
+
+	for tileRow := 1; tileRow < grid.rows; tileRow++ {
+		for tileCol := 0; tileCol < grid.cols; tileCol++ {
+			start := grid.colStarts[tileCol]
+			above := (tileRow-1)*grid.cols + tileCol
+			_, aboveHeight := store.tileSize(above)
+			if err := store.readRow(above, aboveHeight-1, before[start:]); err != nil {
+				return err
+			}
+			if err := store.readRow(tileRow*grid.cols+tileCol, 0, after[start:]); err != nil {
+				return err
+			}
+		}
+		mergeSeam(unionFindArray, before[:width], after[:width], connectivity)
+	}
+
+	for tileCol := 1; tileCol < grid.cols; tileCol++ {
+		for tileRow := 0; tileRow < grid.rows; tileRow++ {
+			start := grid.rowStarts[tileRow]
+			tile := tileRow*grid.cols + tileCol
+			if err := store.readCol(tile-1, true, before[start:]); err != nil {
+				return err
+			}
+			if err := store.readCol(tile, false, after[start:]); err != nil {
+				return err
+			}
+		}
+		mergeSeam(unionFindArray, before[:height], after[:height], connectivity)
+	}
+
+	return nil
+}
+
+// RunIconTiled is RunIconContext for images too big to decode into memory
+// the image is read from src a tile at a time (Options.TileWidth/TileHeight,
+// 1024 by default) - the first pass finds the background, the second labels
+// each tile and saves its labels to a temporary file (in Options.TempDir)
+// the seams are then read back and merged with the union find, and the icon
+// is written to w as a png row by row, holding a band of tiles at a time
+// the gradient model, auto threshold, morphology, hole filling and absorbing
+// speckles need the whole image and aren't supported, nor is the Debug image
+// the tiles are always labeled one after the other on the TileWidth/TileHeight
+// grid, so Chunks, ChunkRows/ChunkCols, Threaded, Workers and Calibration are
+// rejected too
+// the returned Result has no Icon and its Components can't Contains, the
+// labels are deleted before it returns - when no icon is picked (Selected is
+// -1) nothing is written to w, like the empty image RunIcon returns
+func RunIconTiled(ctx context.Context, src TileReader, w io.Writer, opts Options) (Result, error) {
+	if opts.Model == GradientModel || opts.AutoThreshold || len(opts.Morphology) > 0 ||
+		opts.BorderConnected || opts.MaxHoleArea > 0 || opts.AbsorbSpeckles ||
+		opts.Debug || opts.Chunks != 0 || opts.ChunkRows != 0 || opts.ChunkCols != 0 ||
+		opts.Threaded || opts.Workers != 0 || opts.Calibration != nil {
+		return Result{}, errors.New("transparency: option not supported by RunIconTiled")
+	}
+
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	tileWidth, tileHeight := opts.TileWidth, opts.TileHeight
+	if tileWidth <= 0 {
+		tileWidth = defaultTileSize
+	}
+	if tileHeight <= 0 {
+		tileHeight = defaultTileSize
+	}
+	grid := newTileGrid(width, height, tileWidth, tileHeight)
+
+	// first pass: find the background
+	var palette []Background
+	if len(opts.Palette) > 0 {
+		palette = paletteBackgrounds(opts.Palette)
+	} else {
+		borderWidth := opts.BorderWidth
+		if borderWidth <= 0 {
+			borderWidth = defaultBorderWidth
+		}
+
+		histogram := newColorHistogram()
+		for tile := 0; tile < grid.chunks(); tile++ {
+			matrix, err := readTile(ctx, src, grid, tile)
+			if err != nil {
+				return Result{}, err
+			}
+			startRow, startCol, _, _ := grid.bounds(tile)
+			histogram.addMatrix(matrix, startCol, startRow, width, height, opts.Background, borderWidth)
+		}
+		palette = histogram.palette(opts.PaletteSize)
+	}
+	backgroundClassifier, err := newClassifier(ctx, opts, palette, nil, width, height)
+	if err != nil {
+		return Result{}, err
+	}
+
+	connectivity := opts.Connectivity
+	if connectivity == 0 {
+		connectivity = EightConnected
+	}
+
+	store, err := newTileStore(opts.TempDir, grid)
+	if err != nil {
+		return Result{}, err
+	}
+	defer store.Close()
+
+	// second pass: label every tile on its own and save the labels
+	labelChunk := opts.Labeling.labeler()
+	var componentNum uint64 = 0
+	tileComponentDimensions := make([]map[int]chunkArea, grid.chunks())
+	for tile := range tileComponentDimensions {
+		matrix, err := readTile(ctx, src, grid, tile)
+		if err != nil {
+			return Result{}, err
+		}
+
+		areas := labelChunk(ctx, &componentNum, 0, 0, matrix.height, matrix.width, matrix.width,
+			matrix, backgroundClassifier, connectivity)
+		if err := ctx.Err(); err != nil {
+			return Result{}, err
+		}
+
+		// the tile edges count as exposed until the seams are merged
+		exposedSides(matrix, func(label, sides int) {
+			area := areas[label]
+			area.totals.perimeter += sides
+			areas[label] = area
+		})
+
+		// the tile was labeled on its own, move its components into image coordinates
+		startRow, startCol, _, _ := grid.bounds(tile)
+		for label, area := range areas {
+			area.dimensions[0] += startRow
+			area.dimensions[1] += startRow
+			area.dimensions[2] += startCol
+			area.dimensions[3] += startCol
+			area.totals.sumX += startCol * area.pixels
+			area.totals.sumY += startRow * area.pixels
+			areas[label] = area
+		}
+		tileComponentDimensions[tile] = areas
+
+		if err := store.write(tile, matrix); err != nil {
+			return Result{}, err
+		}
+	}
+
+	components := NewUnionFind(int(componentNum)+1, grid.chunks(), tileComponentDimensions)
+	if err := mergeTileSeams(store, components, width, height, connectivity); err != nil {
+		return Result{}, err
+	}
+
+	labeled := &labeledImage{
+		width:        width,
+		height:       height,
+		palette:      palette,
+		classifier:   backgroundClassifier,
+		connectivity: connectivity,
+		components:   components,
+		tiles:        store,
+	}
+	iconDimensions, iconComponents, componentList, choice := labeled.selectIcon(opts)
+	if err := writeTiledIcon(ctx, src, store, iconDimensions, iconComponents, opts.ChromaKey, w); err != nil {
+		return Result{}, err
+	}
+
+	// the labels behind Contains are about to be deleted
+	for i := range componentList {
+		componentList[i].contains = nil
+	}
+
+	return Result{
+		Background: palette[0],
+		Palette:    palette,
+		Strategy:   opts.Background,
+		Model:      opts.Model,
+
+		Threshold: backgroundClassifier.threshold,
+
+		Components: componentList,
+		Selected:   choice,
+	}, nil
+}
+
+// writeTiledIcon crops the icon out of the tiles the same way
+// buildTransparentImage does, decoding one band of tiles at a time
+// a png can't be empty, so an empty crop writes nothing
+func writeTiledIcon(ctx context.Context, src TileReader, store *tileStore, iconDimensions [4]int,
+	iconComponents map[int]bool, key *ChromaKey, w io.Writer) error {
+	top, bottom, left, right := iconDimensions[0], iconDimensions[1], iconDimensions[2], iconDimensions[3]
+	iconWidth := max(right-left, 0)
+	iconHeight := max(bottom-top, 0)
+	if iconWidth == 0 || iconHeight == 0 {
+		return nil
+	}
+
+	out, err := newPNGRowWriter(w, iconWidth, iconHeight)
+	if err != nil {
+		return err
+	}
+
+	grid := store.grid
+	row := make([]byte, 4*iconWidth)
+	for tileRow := 0; tileRow < grid.rows; tileRow++ {
+		bandTop, bandBottom := max(grid.rowStarts[tileRow], top), min(grid.rowStarts[tileRow+1], bottom)
+		if bandTop >= bandBottom {
+			continue
+		}
+
+		// decode the tiles of the band that overlap the icon
+		var bandTiles []int
+		pixels := make(map[int]*pixelMatrix)
+		labels := make(map[int][]int32)
+		for tileCol := 0; tileCol < grid.cols; tileCol++ {
+			if grid.colStarts[tileCol+1] <= left || grid.colStarts[tileCol] >= right {
+				continue
+			}
+
+			tile := tileRow*grid.cols + tileCol
+			matrix, err := readTile(ctx, src, grid, tile)
+			if err != nil {
+				return err
+			}
+			tileLabels := make([]int32, matrix.width*matrix.height)
+			if err := store.read(tile, 0, tileLabels); err != nil {
+				return err
+			}
+			bandTiles = append(bandTiles, tile)
+			pixels[tile] = matrix
+			labels[tile] = tileLabels
+		}
+
+		for y := bandTop; y < bandBottom; y++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			for i := range row {
+				row[i] = 0
+			}
+			for _, tile := range bandTiles {
+				startRow, startCol, _, endCol := grid.bounds(tile)
+				matrix := pixels[tile]
+				for x := max(startCol, left); x < min(endCol, right); x++ {
+					inx := (y-startRow)*matrix.width + (x - startCol)
+					if !iconComponents[int(labels[tile][inx])] {
+						continue
+					}
+
+					var c color.Color = matrix.color(inx)
+					if key != nil {
+						c = key.apply(matrix.rgb(inx))
+					}
+					// png wants straight alpha, not the premultiplied RGBA
+					n := color.NRGBAModel.Convert(c).(color.NRGBA)
+					copy(row[4*(x-left):], []byte{n.R, n.G, n.B, n.A})
+				}
+			}
+
+			if err := out.WriteRow(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	return out.Close()
+}
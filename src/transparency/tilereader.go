@@ -0,0 +1,184 @@
+package transparency
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"os"
+)
+
+// TileReader decodes an image a region at a time, so RunIconTiled never
+// holds more than a tile (or a band of tiles) of it in memory
+type TileReader interface {
+	// Bounds is the size and position of the whole image
+	Bounds() image.Rectangle
+	// ReadTile decodes the pixels inside r, which is always within Bounds
+	ReadTile(r image.Rectangle) (image.Image, error)
+}
+
+// imageTiles reads the tiles out of an image that is already decoded
+type imageTiles struct {
+	img image.Image
+}
+
+// NewImageTileReader serves the tiles of an in memory image
+// handy to run RunIconTiled on something that already fits in memory
+func NewImageTileReader(img image.Image) TileReader {
+	return imageTiles{img: img}
+}
+
+func (t imageTiles) Bounds() image.Rectangle {
+	return t.img.Bounds()
+}
+
+func (t imageTiles) ReadTile(r image.Rectangle) (image.Image, error) {
+	if sub, ok := t.img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r), nil
+	}
+
+	tile := image.NewRGBA(r)
+	draw.Draw(tile, r, t.img, r.Min, draw.Src)
+	return tile, nil
+}
+
+// PPMReader reads tiles straight out of a binary (P6) PPM file
+// the pixels are stored uncompressed, so any row of a tile can be read
+// without decoding anything before it
+type PPMReader struct {
+	file   *os.File
+	width  int
+	height int
+	maxVal int
+	// offset is where the pixels start, right after the header
+	offset int64
+}
+
+// OpenPPM opens a binary PPM file with 8 bit samples for tiled reading
+func OpenPPM(fileName string) (*PPMReader, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &PPMReader{file: file}
+	if err := reader.readHeader(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return reader, nil
+}
+
+// readHeader parses "P6 <width> <height> <maxval>" and the single whitespace
+// byte before the pixels, skipping # comments
+func (p *PPMReader) readHeader() error {
+	header := &countingReader{r: bufio.NewReader(io.NewSectionReader(p.file, 0, 1<<20))}
+	var fields [4]string
+	for i := range fields {
+		field, err := header.field()
+		if err != nil {
+			return errors.New("truncated ppm header")
+		}
+		fields[i] = field
+	}
+
+	if fields[0] != "P6" {
+		return fmt.Errorf("not a binary ppm (%q)", fields[0])
+	}
+	if _, err := fmt.Sscan(fields[1]+" "+fields[2]+" "+fields[3], &p.width, &p.height, &p.maxVal); err != nil {
+		return fmt.Errorf("bad ppm header: %w", err)
+	}
+	if p.width <= 0 || p.height <= 0 || p.maxVal <= 0 || p.maxVal > 0xff {
+		return fmt.Errorf("unsupported ppm %dx%d with maxval %d", p.width, p.height, p.maxVal)
+	}
+
+	p.offset = header.read
+	return nil
+}
+
+// countingReader tracks how many header bytes were consumed
+type countingReader struct {
+	r    *bufio.Reader
+	read int64
+}
+
+// field returns the next whitespace separated header field, including the
+// whitespace byte after it
+func (c *countingReader) field() (string, error) {
+	var field []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		c.read++
+
+		switch {
+		case b == '#' && len(field) == 0:
+			// comments run to the end of the line
+			line, err := c.r.ReadBytes('\n')
+			if err != nil {
+				return "", err
+			}
+			c.read += int64(len(line))
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r':
+			if len(field) > 0 {
+				return string(field), nil
+			}
+		default:
+			field = append(field, b)
+		}
+	}
+}
+
+func (p *PPMReader) Bounds() image.Rectangle {
+	return image.Rect(0, 0, p.width, p.height)
+}
+
+// ReadTile reads the rows of the tile one at a time
+func (p *PPMReader) ReadTile(r image.Rectangle) (image.Image, error) {
+	tile := image.NewRGBA(r)
+	row := make([]byte, 3*r.Dx())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		if _, err := p.file.ReadAt(row, p.offset+3*(int64(y)*int64(p.width)+int64(r.Min.X))); err != nil {
+			return nil, err
+		}
+
+		out := tile.Pix[tile.PixOffset(r.Min.X, y):]
+		for x := 0; x < r.Dx(); x++ {
+			for i := 0; i < 3; i++ {
+				out[4*x+i] = uint8(int(row[3*x+i]) * 0xff / p.maxVal)
+			}
+			out[4*x+3] = 0xff
+		}
+	}
+	return tile, nil
+}
+
+func (p *PPMReader) Close() error {
+	return p.file.Close()
+}
+
+// WritePPM writes the image as a binary PPM, dropping the alpha channel
+// eg to convert a scan once so RunIconTiled can read it in tiles
+func WritePPM(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	out := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(out, "P6\n%d %d\n255\n", bounds.Dx(), bounds.Dy()); err != nil {
+		return err
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			if _, err := out.Write([]byte{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)}); err != nil {
+				return err
+			}
+		}
+	}
+	return out.Flush()
+}
@@ -0,0 +1,156 @@
+package transparency
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// LabelingAlgorithm picks how each chunk's connected components are labeled
+type LabelingAlgorithm int
+
+const (
+	// DFSLabeling floods every component from its first pixel with an explicit stack
+	DFSLabeling LabelingAlgorithm = iota
+	// TwoPassLabeling scans the chunk row by row, recording label equivalences
+	// in a small union find, then resolves them in a second scan - each pixel
+	// is classified once and there's no stack to grow
+	TwoPassLabeling
+)
+
+func (a LabelingAlgorithm) String() string {
+	switch a {
+	case DFSLabeling:
+		return "dfs"
+	case TwoPassLabeling:
+		return "two-pass"
+	}
+	return fmt.Sprintf("LabelingAlgorithm(%d)", int(a))
+}
+
+// chunkLabeler labels the components of one chunk of the matrix in place
+// taking its labels from the shared componentInx counter
+// a cancelled ctx makes it return early, the caller checks ctx and drops the labels
+type chunkLabeler func(ctx context.Context, componentInx *uint64,
+	startRow int, startCol int, endRow int, endCol int, width int,
+	matrix *pixelMatrix, background *classifier, connectivity Connectivity) map[int]chunkArea
+
+func (a LabelingAlgorithm) labeler() chunkLabeler {
+	if a == TwoPassLabeling {
+		return findIconInChunkTwoPass
+	}
+	return findIconInChunk
+}
+
+// equivalences is the provisional label table of the first pass
+type equivalences []int
+
+// find returns the smallest provisional label equivalent to label
+func (e equivalences) find(label int) int {
+	for e[label] != label {
+		e[label] = e[e[label]]
+		label = e[label]
+	}
+	return label
+}
+
+// union keeps the smaller root so labels resolve in scan order
+func (e equivalences) union(p, q int) int {
+	pRoot, qRoot := e.find(p), e.find(q)
+	if pRoot < qRoot {
+		e[qRoot] = pRoot
+		return pRoot
+	}
+	e[pRoot] = qRoot
+	return qRoot
+}
+
+// findIconInChunkTwoPass labels the chunk with the classic two-pass algorithm
+// https://en.wikipedia.org/wiki/Connected-component_labeling#Two-pass
+func findIconInChunkTwoPass(ctx context.Context, componentInx *uint64,
+	startRow int, startCol int, endRow int, endCol int, width int,
+	matrix *pixelMatrix, background *classifier, connectivity Connectivity) map[int]chunkArea {
+
+	// neighbors already visited in scan order (left, then the row above)
+	previous := [][2]int{{-1, 0}, {0, -1}}
+	if connectivity != FourConnected {
+		previous = [][2]int{{-1, 0}, {-1, -1}, {0, -1}, {1, -1}}
+	}
+
+	// provisional label 0 is unused so the table lines up with the labels
+	table := equivalences{0}
+
+	// first pass: classify once, take the smallest neighboring label
+	for row := startRow; row < endRow; row++ {
+		if ctx.Err() != nil {
+			return nil
+		}
+		for col := startCol; col < endCol; col++ {
+			inx := row*width + col
+			if background.isBackground(matrix.rgb(inx), col, row) {
+				matrix.setLabel(inx, -1)
+				continue
+			}
+
+			label := 0
+			for _, offset := range previous {
+				neighborCol, neighborRow := col+offset[0], row+offset[1]
+				if neighborCol < startCol || neighborCol >= endCol || neighborRow < startRow {
+					continue
+				}
+
+				neighbor := matrix.label(neighborRow*width + neighborCol)
+				if neighbor <= 0 {
+					continue
+				}
+				if label == 0 {
+					label = table.find(neighbor)
+				} else {
+					label = table.union(label, neighbor)
+				}
+			}
+
+			if label == 0 {
+				label = len(table)
+				table = append(table, label)
+			}
+			matrix.setLabel(inx, label)
+		}
+	}
+
+	// number the roots in scan order and reserve that many unique labels
+	final := make([]int, len(table))
+	roots := 0
+	for label := 1; label < len(table); label++ {
+		if table.find(label) == label {
+			roots++
+			final[label] = roots
+		}
+	}
+	base := int(atomic.AddUint64(componentInx, uint64(roots))) - roots
+
+	// second pass: resolve equivalences and sum up each component
+	componentDimensionMap := make(map[int]chunkArea, roots)
+	for row := startRow; row < endRow; row++ {
+		for col := startCol; col < endCol; col++ {
+			inx := row*width + col
+			if matrix.label(inx) <= 0 {
+				continue
+			}
+
+			component := base + final[table.find(matrix.label(inx))]
+			matrix.setLabel(inx, component)
+
+			area, ok := componentDimensionMap[component]
+			if !ok {
+				area.dimensions = [4]int{MaxInt, 0, MaxInt, 0}
+			}
+			area.pixels++
+			area.dimensions = mergeDimensions(area.dimensions, [4]int{row, row, col, col})
+			area.totals.addPixel(col, row, matrix.rgb(inx))
+			componentDimensionMap[component] = area
+		}
+	}
+
+	return componentDimensionMap
+}
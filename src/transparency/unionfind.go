@@ -1,10 +1,13 @@
 package transparency
 
+import "sync/atomic"
+
 // Code referenced from https://github.com/theodesp/unionfind/blob/master/unionfind.go
 
 type UnionFindArea struct {
 	totalPixels     int
 	totalDimensions [4]int
+	totals          componentTotals
 }
 
 type UnionFind struct {
@@ -32,6 +35,7 @@ func (uf *UnionFind) init(
 			item := UnionFindArea{
 				totalPixels:     v.pixels,
 				totalDimensions: v.dimensions,
+				totals:          v.totals,
 			}
 
 			uf.root[k] = k
@@ -66,24 +70,26 @@ func mergeDimensions(dimension1, dimension2 [4]int) [4]int {
 	}
 }
 
-// Union/merge smaller area into larger area
-func (uf *UnionFind) mergeInto(larger int, smaller int) {
-	rootLarge := uf.root[larger]
-	rootSmall := uf.root[smaller]
+// mergeInto adds the area of the from root to the into root
+func (uf *UnionFind) mergeInto(into int, from int) {
+	intoRoot := uf.root[into]
+	fromRoot := uf.root[from]
 
-	largeArea := uf.area[rootLarge]
-	smallArea := uf.area[rootSmall]
+	intoArea := uf.area[intoRoot]
+	fromArea := uf.area[fromRoot]
 
-	largeArea.totalDimensions = mergeDimensions(
-		largeArea.totalDimensions,
-		smallArea.totalDimensions,
+	intoArea.totalDimensions = mergeDimensions(
+		intoArea.totalDimensions,
+		fromArea.totalDimensions,
 	)
-	largeArea.totalPixels += smallArea.totalPixels
-	uf.area[rootLarge] = largeArea
+	intoArea.totalPixels += fromArea.totalPixels
+	intoArea.totals.add(fromArea.totals)
+	uf.area[intoRoot] = intoArea
 }
 
-// Union connects p and q by finding their roots and comparing their respective
-// size arrays to keep the tree flat
+// Union connects p and q by linking the higher root under the lower one, so
+// every set is rooted at its lowest label like the concurrentUnionFind and
+// the labels don't depend on the order the unions ran in
 func (uf *UnionFind) Union(p int, q int) {
 	qRoot := uf.Root(q)
 	pRoot := uf.Root(p)
@@ -92,13 +98,13 @@ func (uf *UnionFind) Union(p int, q int) {
 		return
 	}
 
-	if uf.size[qRoot] < uf.size[pRoot] {
+	if pRoot < qRoot {
 		uf.mergeInto(pRoot, qRoot)
-		uf.root[qRoot] = uf.root[pRoot]
+		uf.root[qRoot] = pRoot
 		uf.size[pRoot] += uf.size[qRoot]
 	} else {
 		uf.mergeInto(qRoot, pRoot)
-		uf.root[pRoot] = uf.root[qRoot]
+		uf.root[pRoot] = qRoot
 		uf.size[qRoot] += uf.size[pRoot]
 	}
 }
@@ -133,3 +139,70 @@ func (uf *UnionFind) FindArea(p int) UnionFindArea {
 func (uf *UnionFind) Connected(p int, q int) bool {
 	return uf.Root(p) == uf.Root(q)
 }
+
+// concurrentUnionFind is a lock free union find for merging seams from many
+// goroutines, links are swapped in with compare-and-swap and a root is always
+// linked under the lower of the two roots, so every set is rooted at its
+// lowest label whatever order the unions ran in
+// it only tracks the links, flatten hands the sets over to a UnionFind
+type concurrentUnionFind struct {
+	parent []int32
+}
+
+func newConcurrentUnionFind(components int) *concurrentUnionFind {
+	parent := make([]int32, components)
+	for i := range parent {
+		parent[i] = int32(i)
+	}
+	return &concurrentUnionFind{parent: parent}
+}
+
+// find walks up to the root, halving the path as it goes
+// a lost race on the halving is harmless, the parent only ever moves closer to the root
+func (u *concurrentUnionFind) find(p int32) int32 {
+	for {
+		parent := atomic.LoadInt32(&u.parent[p])
+		if parent == p {
+			return p
+		}
+		grandparent := atomic.LoadInt32(&u.parent[parent])
+		if grandparent != parent {
+			atomic.CompareAndSwapInt32(&u.parent[p], parent, grandparent)
+		}
+		p = parent
+	}
+}
+
+// Union links the higher root under the lower one, retrying when another
+// goroutine relinked either root in between
+func (u *concurrentUnionFind) Union(p int, q int) {
+	pRoot, qRoot := int32(p), int32(q)
+	for {
+		pRoot, qRoot = u.find(pRoot), u.find(qRoot)
+		if pRoot == qRoot {
+			return
+		}
+		if pRoot < qRoot {
+			pRoot, qRoot = qRoot, pRoot
+		}
+		// only succeeds while pRoot is still a root
+		if atomic.CompareAndSwapInt32(&u.parent[pRoot], pRoot, qRoot) {
+			return
+		}
+	}
+}
+
+// flatten merges every set into uf once the concurrent unions are done
+// labels go in ascending order, so each root is merged into before it's linked
+func (u *concurrentUnionFind) flatten(uf *UnionFind) {
+	for label := 1; label < len(u.parent); label++ {
+		root := int(u.find(int32(label)))
+		if root == label {
+			continue
+		}
+
+		uf.mergeInto(root, label)
+		uf.root[label] = root
+		uf.size[root] += uf.size[label]
+	}
+}